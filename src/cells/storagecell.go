@@ -2,55 +2,111 @@ package main
 
 import (
 	"os"
-	"log"
+	"log/slog"
 	"strconv"
 	"io"
 	"io/ioutil"
 	"encoding/json"
-	"fmt"
 	"net/http"
 	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+	"context"
+	_ "embed"
+	"net"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 const Memory = 100
 
 var CellPort string
 
+var CellGrpcPort string
+
 var CellDataPath string
 
+var ControllerURL string
+
+// ControllerAPIKey goes with corruption reports, which need admin
+var ControllerAPIKey string
+
+var CellId int
+
 type KeyValue struct {
 	Key	string	`json:"key"`
 	Value	string  `json:"value"`
+	Checksum	string	`json:"checksum,omitempty"`
 }
 
 type KeyStore struct {
 	freememory int
 	storage map[string] string
+	checksums map[string] string
+	// handlers and the scrubber both touch the maps
+	lock sync.Mutex
+}
+
+// Checksums are hex encoded SHA-256 sums, sent by the controller with
+// every write and kept in the file next to the value
+const ChecksumHeader = "X-Checksum-Sha256"
+
+func Checksum(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+type keyValuePair struct {
+	Id	string	`json:"id"`
+	Payload	string	`json:"payload"`
+	Size	int	`json:"size"`
 }
 
-func createKeyValuePairs(m map[string]string) string {
-	b := new(bytes.Buffer)
-	firstTime := true
-	fmt.Fprintf(b, "[")
+func createKeyValuePairs(m map[string]string) []keyValuePair {
+	pairs := []keyValuePair{}
 	for key, value := range m {
-		if firstTime == false {
-			fmt.Fprintf(b, ", ")
-		}
-		firstTime = false
-		fmt.Fprintf(b, "{\"id\":\"%s\", \"payload\":\"%s\", \"size\":%d}", key, value, len(value))
+		pairs = append(pairs, keyValuePair{key, value, len(value)})
 	}
-	fmt.Fprintf(b, "]")
-	return b.String()
+	return pairs
 }
 
 func (s *KeyStore) String() string {
-	return "{\"free\":" + strconv.Itoa(s.freememory) + ", \"storage\":" + createKeyValuePairs(s.storage) + "}"
+	res, _ := json.Marshal(struct {
+		Free	int	`json:"free"`
+		Storage	[]keyValuePair	`json:"storage"`
+	}{s.freememory, createKeyValuePairs(s.storage)})
+	return string(res)
 }
 
 func (s *KeyStore) Initialize() {
 	s.freememory = Memory
 	s.storage = make(map[string] string)
+	s.checksums = make(map[string] string)
 }
 
 func (s *KeyStore) Store(key string, value string) bool {
@@ -75,6 +131,7 @@ func (s *KeyStore) Delete(key string) bool {
 	if _, exists := s.storage[key]; exists {
 		s.freememory += len(s.storage[key])
 		delete(s.storage, key)
+		delete(s.checksums, key)
 		return true
 	} else {
 		return false
@@ -88,11 +145,56 @@ var keyStore* KeyStore
 // Utilities
 
 func JSONResponseFromString(w http.ResponseWriter, res string) {
+        JSONResponseWithStatus(w, http.StatusOK, res)
+}
+
+func JSONResponseWithStatus(w http.ResponseWriter, status int, res string) {
         w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-        w.WriteHeader(http.StatusOK)
+        w.WriteHeader(status)
         io.WriteString(w, res)
 }
 
+// Errors look the same as the controller's: {"error": {"code", "message", "requestid"}}
+type APIError struct {
+	Code	string	`json:"code"`
+	Message	string	`json:"message"`
+	RequestId	string	`json:"requestid"`
+}
+
+const (
+	ErrCodeChecksumMismatch = "checksum_mismatch"
+	ErrCodeNotFound = "not_found"
+	ErrCodeInsufficientStorage = "insufficient_storage"
+	ErrCodeUnauthorized = "unauthorized"
+	ErrCodeInternal = "internal"
+)
+
+const RequestIdHeader = "X-Request-Id"
+
+func JSONError(w http.ResponseWriter, r *http.Request, status int, code string, message string) {
+	id := requestIdFrom(r.Context())
+	if id == "" {
+		id = newRequestId()
+	}
+	res, _ := json.Marshal(struct {
+		Error	APIError	`json:"error"`
+	}{APIError{code, message, id}})
+	w.Header().Set(RequestIdHeader, id)
+	JSONResponseWithStatus(w, status, string(res))
+}
+
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// checksumFromRequest returns the checksum of value, or an error if the
+// controller sent one that does not match what arrived
+func checksumFromRequest(r *http.Request, value string) (string, error) {
+	checksum := Checksum(value)
+	if expected := r.Header.Get(ChecksumHeader); expected != "" && expected != checksum {
+		return "", errChecksumMismatch
+	}
+	return checksum, nil
+}
+
 
 
 
@@ -100,9 +202,9 @@ func JSONResponseFromString(w http.ResponseWriter, res string) {
 
 // File ops
 
-func StoreKeyValue(key string, value string) error {
+func StoreKeyValue(key string, value string, checksum string) error {
 
-	data := &KeyValue{Key:key,Value:value}
+	data := &KeyValue{Key:key,Value:value,Checksum:checksum}
 
 	length := len(value)
 
@@ -110,7 +212,99 @@ func StoreKeyValue(key string, value string) error {
 
 	filepath := CellDataPath + "/" + key + "-" + strconv.Itoa(length) + ".json"
 
-	return ioutil.WriteFile(filepath, filedata, 0644)
+	start := time.Now()
+	err := ioutil.WriteFile(filepath, filedata, 0644)
+	observeDisk("write", start, err)
+	return err
+
+}
+
+func DeleteKeyValue(key string, length int) error {
+
+	filepath := CellDataPath + "/" + key + "-" + strconv.Itoa(length) + ".json"
+
+	start := time.Now()
+	err := os.Remove(filepath)
+	observeDisk("delete", start, err)
+	return err
+
+}
+
+var errCellFull = errors.New("not enough free space on this cell")
+
+// putValue stores value under key, replacing what was there before, and
+// keeps the keystore in step with the files. The caller holds the lock.
+// A value that does not fit is refused: the controller reserves room before
+// writing, but if its accounting is off the cell must not overfill.
+func putValue(ctx context.Context, key string, value string, checksum string) error {
+	_, span := tracer.Start(ctx, "putValue", trace.WithAttributes(attribute.String("eks.key", key), attribute.Int("eks.bytes", len(value))))
+	defer span.End()
+	old, exists := keyStore.storage[key]
+	if len(value)-len(old) > keyStore.freememory {
+		slog.WarnContext(ctx, "refusing value, cell is full", "key", key, "size", len(value), "free", keyStore.freememory)
+		span.SetStatus(otelcodes.Error, errCellFull.Error())
+		return errCellFull
+	}
+	err := StoreKeyValue(key, value, checksum)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(otelcodes.Error, err.Error())
+		return err
+	}
+	// the length is part of the file name, so a resized value leaves the old file behind
+	if exists && len(old) != len(value) {
+		if err = DeleteKeyValue(key, len(old)); err != nil {
+			slog.WarnContext(ctx, "could not remove old file", "key", key, "error", err)
+		}
+	}
+	keyStore.storage[key] = value
+	keyStore.checksums[key] = checksum
+	keyStore.freememory += len(old) - len(value)
+	return nil
+}
+
+// deleteValue removes the file for key and then the key itself. The caller
+// holds the lock.
+func deleteValue(key string, value string) error {
+	err := DeleteKeyValue(key, len(value))
+	if err != nil {
+		return err
+	}
+	keyStore.Delete(key)
+	return nil
+}
+
+// RestoreKeyValues loads every file under CellDataPath back into the
+// keystore, so a restarted cell reports what it actually holds
+func RestoreKeyValues(s *KeyStore) error {
+
+	files, err := ioutil.ReadDir(CellDataPath)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		start := time.Now()
+		filedata, err := ioutil.ReadFile(CellDataPath + "/" + file.Name())
+		observeDisk("read", start, err)
+		if err != nil {
+			slog.Warn("could not read file", "file", file.Name(), "error", err)
+			continue
+		}
+		data := &KeyValue{}
+		if err = json.Unmarshal(filedata, data); err != nil {
+			slog.Warn("could not parse file", "file", file.Name(), "error", err)
+			continue
+		}
+		s.storage[data.Key] = data.Value
+		s.checksums[data.Key] = data.Checksum
+		s.freememory -= len(data.Value)
+	}
+
+	return nil
 
 }
 
@@ -121,47 +315,81 @@ func StoreKeyValue(key string, value string) error {
 
 // REST API Handlers
 func HealthCheck(w http.ResponseWriter, r *http.Request) {
-        fmt.Fprintln(w, "{'status':'alive'}")
+        JSONResponseFromString(w, "{\"status\":\"alive\"}")
+}
+
+// openapi.json describes the REST routes set up in main
+//
+//go:embed openapi.json
+var openAPISpec string
+
+func OpenAPISpec(w http.ResponseWriter, r *http.Request) {
+	JSONResponseFromString(w, openAPISpec)
 }
 
 func ReportCellInfo(w http.ResponseWriter, r *http.Request) {
+	keyStore.lock.Lock()
+	defer keyStore.lock.Unlock()
 	JSONResponseFromString(w, "{\"available\":"+strconv.Itoa(keyStore.freememory)+"}")
 }
 
 func StoreItem(w http.ResponseWriter, r *http.Request) {
 	// thou shalt not store the item unless it fits
-	// but it's the controller's responsibility to decide 
-	// and enforce that
+	// the controller decides where it goes, putValue
+	// makes sure it fits
 
+	keyStore.lock.Lock()
+	defer keyStore.lock.Unlock()
 	vars := mux.Vars(r)
-        fmt.Println("  # cell # Attempting to store value " + vars["info"] + " in key " + vars["id"])
-        err := StoreKeyValue(vars["id"], vars["info"])    //keyStore.Store(vars["id"], vars["info"])
+        slog.DebugContext(r.Context(), "storing", "key", vars["id"], "size", len(vars["info"]))
+        checksum, err := checksumFromRequest(r, vars["info"])
+        if(err != nil) {
+                JSONError(w, r, http.StatusBadRequest, ErrCodeChecksumMismatch, err.Error())
+                return
+        }
+        err = putValue(r.Context(), vars["id"], vars["info"], checksum)
         if(err == nil) {
                 JSONResponseFromString(w, "{\"result\":\"'success'\"}")
+        } else if(err == errCellFull) {
+                JSONError(w, r, http.StatusInsufficientStorage, ErrCodeInsufficientStorage, err.Error())
         } else {
-                JSONResponseFromString(w, "{\"error\":\""+err.Error()+"\"}")
+                JSONError(w, r, http.StatusInternalServerError, ErrCodeInternal, err.Error())
         }
 }
 
 func RetrieveItem(w http.ResponseWriter, r *http.Request) {
+	keyStore.lock.Lock()
+	defer keyStore.lock.Unlock()
 	vars := mux.Vars(r)
-        fmt.Println("  # cell # Attempting to retrieve value " + vars["id"])
+        slog.DebugContext(r.Context(), "retrieving", "key", vars["id"])
         success, value := keyStore.Retrieve(vars["id"])
         if(success) {
-                JSONResponseFromString(w, "{\"result\":\"OK\", \"value\":"+value+"}")
+                res, _ := json.Marshal(struct {
+                        Result   string `json:"result"`
+                        Value    string `json:"value"`
+                        Checksum string `json:"checksum"`
+                }{"OK", value, keyStore.checksums[vars["id"]]})
+                JSONResponseFromString(w, string(res))
         } else {
-                JSONResponseFromString(w, "{\"result\":\"not found\"}, \"value\":\"\"}")
+                JSONError(w, r, http.StatusNotFound, ErrCodeNotFound, "key not found")
         }
 }
 
 func DeleteItem(w http.ResponseWriter, r *http.Request) {
+	keyStore.lock.Lock()
+	defer keyStore.lock.Unlock()
 	vars := mux.Vars(r)
-	fmt.Println("  # cell # Attempting to delete key " + vars["id"])
-        status := keyStore.Delete(vars["id"])
-        if(status) {
+	slog.DebugContext(r.Context(), "deleting", "key", vars["id"])
+        success, value := keyStore.Retrieve(vars["id"])
+        if(success) {
+                err := deleteValue(vars["id"], value)
+                if(err != nil) {
+                        JSONError(w, r, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+                        return
+                }
                 JSONResponseFromString(w, "{\"result\":\"success\"}")
         } else {
-                JSONResponseFromString(w, "{\"result\":\"not ok\"}")
+                JSONError(w, r, http.StatusNotFound, ErrCodeNotFound, "key not found")
         }
 }
 
@@ -170,51 +398,799 @@ func Contains(w http.ResponseWriter, r *http.Request) {
 }
 
 func ListStore(w http.ResponseWriter, r *http.Request) {
+	keyStore.lock.Lock()
+	defer keyStore.lock.Unlock()
 	JSONResponseFromString(w, "{\"result\":"+keyStore.String()+"}")
 }
 
 func UpdateItem(w http.ResponseWriter, r *http.Request) {
+	keyStore.lock.Lock()
+	defer keyStore.lock.Unlock()
 	vars := mux.Vars(r)
 	key := vars["id"]
-	if status, value := keyStore.Retrieve(key); status {
-		keyStore.Delete(key)
-		keyStore.Store(key, value)
-		JSONResponseFromString(w, "{\"result\":\"key not found\"}")
+	slog.DebugContext(r.Context(), "updating", "key", key, "size", len(vars["info"]))
+	if status, _ := keyStore.Retrieve(key); status {
+		checksum, err := checksumFromRequest(r, vars["info"])
+		if err != nil {
+			JSONError(w, r, http.StatusBadRequest, ErrCodeChecksumMismatch, err.Error())
+			return
+		}
+		err = putValue(r.Context(), key, vars["info"], checksum)
+		if err == errCellFull {
+			JSONError(w, r, http.StatusInsufficientStorage, ErrCodeInsufficientStorage, err.Error())
+			return
+		} else if err != nil {
+			JSONError(w, r, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+			return
+		}
+		JSONResponseFromString(w, "{\"result\":\"success\"}")
 	} else {
-		JSONResponseFromString(w, "{\"result\":\"key not found\"}")
+		JSONError(w, r, http.StatusNotFound, ErrCodeNotFound, "key not found")
 	}
 }
 
+// gRPC API
+
+// The controller talks to cells over gRPC; the REST handlers above stay
+// for older controllers and for poking at a cell by hand.
+
+// grpcChunkSize is how much of a value goes in each streamed message
+const grpcChunkSize = 64 * 1024
+
+type cellServer struct {
+	UnimplementedCellServer
+}
+
+// validKey keeps a key to a file name in CellDataPath; REST keys are path
+// segments already, but gRPC ones can be anything
+func validKey(key string) bool {
+	return key != "" && !strings.ContainsAny(key, "/\\") && !strings.Contains(key, "..")
+}
+
+func (c *cellServer) Put(stream Cell_PutServer) error {
+	var key, checksum string
+	var update bool
+	var value bytes.Buffer
+	for first := true; ; first = false {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if first {
+			key, checksum, update = req.Key, req.Checksum, req.Update
+		}
+		value.Write(req.Chunk)
+	}
+	if !validKey(key) {
+		return status.Error(codes.InvalidArgument, "bad key")
+	}
+	slog.DebugContext(stream.Context(), "storing", "key", key, "size", value.Len())
+	actual := Checksum(value.String())
+	if checksum != "" && checksum != actual {
+		return status.Error(codes.DataLoss, "checksum mismatch")
+	}
+
+	keyStore.lock.Lock()
+	defer keyStore.lock.Unlock()
+	if _, exists := keyStore.storage[key]; update && !exists {
+		return status.Error(codes.NotFound, "key not found")
+	}
+	if err := putValue(stream.Context(), key, value.String(), actual); err == errCellFull {
+		return status.Error(codes.ResourceExhausted, err.Error())
+	} else if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	return stream.SendAndClose(&PutResponse{Size: int64(value.Len()), Free: int64(keyStore.freememory)})
+}
+
+func (c *cellServer) Get(req *GetRequest, stream Cell_GetServer) error {
+	if !validKey(req.Key) {
+		return status.Error(codes.InvalidArgument, "bad key")
+	}
+	keyStore.lock.Lock()
+	exists, value := keyStore.Retrieve(req.Key)
+	checksum := keyStore.checksums[req.Key]
+	keyStore.lock.Unlock()
+	if !exists {
+		return status.Error(codes.NotFound, "key not found")
+	}
+
+	// an empty value still gets one message, for the checksum
+	for offset := 0; offset == 0 || offset < len(value); offset += grpcChunkSize {
+		end := offset + grpcChunkSize
+		if end > len(value) {
+			end = len(value)
+		}
+		res := &GetResponse{Chunk: []byte(value[offset:end])}
+		if offset == 0 {
+			res.Checksum = checksum
+		}
+		if err := stream.Send(res); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *cellServer) Delete(ctx context.Context, req *DeleteRequest) (*DeleteResponse, error) {
+	if !validKey(req.Key) {
+		return nil, status.Error(codes.InvalidArgument, "bad key")
+	}
+	keyStore.lock.Lock()
+	defer keyStore.lock.Unlock()
+	slog.DebugContext(ctx, "deleting", "key", req.Key)
+	exists, value := keyStore.Retrieve(req.Key)
+	if !exists {
+		return nil, status.Error(codes.NotFound, "key not found")
+	}
+	if err := deleteValue(req.Key, value); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &DeleteResponse{Size: int64(len(value)), Free: int64(keyStore.freememory)}, nil
+}
+
+func (c *cellServer) List(req *ListRequest, stream Cell_ListServer) error {
+	keyStore.lock.Lock()
+	entries := make([]*ListEntry, 0, len(keyStore.storage))
+	for key, value := range keyStore.storage {
+		entries = append(entries, &ListEntry{Key: key, Size: int64(len(value)), Checksum: keyStore.checksums[key]})
+	}
+	keyStore.lock.Unlock()
+
+	for _, entry := range entries {
+		if err := stream.Send(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *cellServer) Info(ctx context.Context, req *InfoRequest) (*InfoResponse, error) {
+	keyStore.lock.Lock()
+	defer keyStore.lock.Unlock()
+	return &InfoResponse{CellId: int32(CellId), Free: int64(keyStore.freememory), Keys: int64(len(keyStore.storage))}, nil
+}
+
+func (c *cellServer) Health(ctx context.Context, req *HealthRequest) (*HealthResponse, error) {
+	return &HealthResponse{Status: "alive"}, nil
+}
+
+func ServeGRPC(port string) {
+	listener, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		slog.Error("could not listen for gRPC", "port", port, "error", err)
+		os.Exit(1)
+	}
+	options := []grpc.ServerOption{grpc.ChainUnaryInterceptor(requestIdUnary), grpc.ChainStreamInterceptor(requestIdStream),
+		grpc.StatsHandler(otelgrpc.NewServerHandler())}
+	if cellTLS != nil {
+		// nothing on the gRPC API is for anyone but the controller
+		options = append(options, grpc.Creds(credentials.NewTLS(cellTLS.serverConfig(tls.RequireAnyClientCert))))
+	}
+	server := grpc.NewServer(options...)
+	RegisterCellServer(server, &cellServer{})
+	slog.Info("storage cell gRPC API started", "port", port)
+	if err := server.Serve(listener); err != nil {
+		slog.Error("gRPC API stopped", "error", err)
+		os.Exit(1)
+	}
+}
+
+// Scrubber
+
+// The scrubber walks the files under CellDataPath at a leisurely pace and
+// checks every value against the checksum stored with it. A rotten file is
+// rewritten from memory when the copy we serve reads from is still good,
+// and either way the controller gets to hear about it.
+func Scrub(interval time.Duration, pause time.Duration) {
+	for {
+		time.Sleep(interval)
+		ctx := backgroundContext("scrub")
+		files, err := ioutil.ReadDir(CellDataPath)
+		if err != nil {
+			slog.ErrorContext(ctx, "scrubber could not read data path", "path", CellDataPath, "error", err)
+			continue
+		}
+		corrupt := 0
+		for _, file := range files {
+			if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+				continue
+			}
+			if !ScrubFile(ctx, file.Name()) {
+				corrupt++
+			}
+			time.Sleep(pause)
+		}
+		slog.InfoContext(ctx, "scrubbed", "files", len(files), "corrupt", corrupt)
+	}
+}
+
+// ScrubFile returns false if the file did not hold what it should
+func ScrubFile(ctx context.Context, name string) bool {
+	keyStore.lock.Lock()
+	defer keyStore.lock.Unlock()
+
+	start := time.Now()
+	filedata, err := ioutil.ReadFile(CellDataPath + "/" + name)
+	if err != nil {
+		// deleted while we were walking
+		return true
+	}
+	observeDisk("read", start, nil)
+	data := &KeyValue{}
+	if err = json.Unmarshal(filedata, data); err == nil {
+		if data.Checksum == "" || Checksum(data.Value) == data.Checksum {
+			return true
+		}
+	}
+
+	// the name is key-length.json, and a key may well have dashes in it
+	key := strings.TrimSuffix(name, ".json")
+	if dash := strings.LastIndex(key, "-"); dash != -1 {
+		key = key[:dash]
+	}
+	slog.WarnContext(ctx, "scrubber found corrupt file", "file", name, "key", key)
+	corruptionsFound.Inc()
+
+	repaired := false
+	if value, exists := keyStore.storage[key]; exists {
+		checksum := keyStore.checksums[key]
+		if checksum != "" && Checksum(value) == checksum {
+			repaired = StoreKeyValue(key, value, checksum) == nil
+		}
+	}
+	go ReportCorruption(ctx, key, repaired)
+	return false
+}
+
+func ReportCorruption(ctx context.Context, key string, repaired bool) {
+	url := ControllerURL + "/admin/corruption/" + strconv.Itoa(CellId) + "/" + key + "?repaired=" + strconv.FormatBool(repaired)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, url, nil)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(RequestIdHeader, requestIdFrom(ctx))
+	if ControllerAPIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+ControllerAPIKey)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		slog.WarnContext(ctx, "could not report corruption", "key", key, "error", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		slog.WarnContext(ctx, "controller refused corruption report", "key", key, "status", resp.StatusCode)
+	}
+}
+
+// Metrics
+
+// Served on /metrics for Prometheus, next to the controller's own
+// eks_controller_ ones
+
+var diskDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "eks_cell_disk_operation_duration_seconds",
+	Help:    "Time taken by file operations under the data path, by operation.",
+	Buckets: prometheus.ExponentialBuckets(0.0001, 2, 16),
+}, []string{"op"})
+
+var diskErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "eks_cell_disk_errors_total",
+	Help: "File operations under the data path that failed, by operation.",
+}, []string{"op"})
+
+var corruptionsFound = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "eks_cell_corruptions_found_total",
+	Help: "Files the scrubber found not matching their checksum.",
+})
+
+func observeDisk(op string, start time.Time, err error) {
+	if err != nil {
+		diskErrors.WithLabelValues(op).Inc()
+		return
+	}
+	diskDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+}
+
+// keyStoreGauge reads a number off the keystore under its lock at scrape time
+func keyStoreGauge(name string, help string, read func(s *KeyStore) int) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        name,
+		Help:        help,
+		ConstLabels: prometheus.Labels{"cell": strconv.Itoa(CellId)},
+	}, func() float64 {
+		keyStore.lock.Lock()
+		defer keyStore.lock.Unlock()
+		return float64(read(keyStore))
+	})
+}
+
+func registerMetrics() {
+	keyStoreGauge("eks_cell_items", "Values held by the cell.", func(s *KeyStore) int { return len(s.storage) })
+	keyStoreGauge("eks_cell_used_bytes", "Bytes taken by the values held.", func(s *KeyStore) int { return Memory - s.freememory })
+	keyStoreGauge("eks_cell_free_bytes", "Bytes still free.", func(s *KeyStore) int { return s.freememory })
+	keyStoreGauge("eks_cell_capacity_bytes", "Bytes the cell can hold.", func(s *KeyStore) int { return Memory })
+}
+
+// Logging
+
+// Everything logs through slog, as JSON on stdout unless LOG_FORMAT=text,
+// at LOG_LEVEL (debug, info, warn or error) and up. The controller sends its
+// request id along, in the X-Request-Id header or the x-request-id gRPC
+// metadata, so one request can be followed from the controller's log into
+// the cell's.
+
+const requestIdMetadata = "x-request-id"
+
+type contextKey int
+
+const requestIdKey contextKey = 0
+
+func newRequestId() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+func withRequestId(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIdKey, id)
+}
+
+func requestIdFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIdKey).(string)
+	return id
+}
+
+// backgroundContext is for the scrubber, which no request started
+func backgroundContext(operation string) context.Context {
+	return withRequestId(context.Background(), operation+"-"+newRequestId())
+}
+
+// requestIdHandler adds the request id, if the context has one, to every
+// record, and the trace id when the request is being traced
+type requestIdHandler struct {
+	slog.Handler
+}
+
+func (h requestIdHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := requestIdFrom(ctx); id != "" {
+		record.AddAttrs(slog.String("requestid", id))
+	}
+	if span := trace.SpanContextFromContext(ctx); span.IsSampled() {
+		record.AddAttrs(slog.String("traceid", span.TraceID().String()))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h requestIdHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIdHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIdHandler) WithGroup(name string) slog.Handler {
+	return requestIdHandler{h.Handler.WithGroup(name)}
+}
+
+func setupLogging() {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(os.Getenv("LOG_LEVEL"))); err != nil {
+		level = slog.LevelInfo
+	}
+	options := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	if strings.ToLower(os.Getenv("LOG_FORMAT")) == "text" {
+		handler = slog.NewTextHandler(os.Stdout, options)
+	} else {
+		handler = slog.NewJSONHandler(os.Stdout, options)
+	}
+	slog.SetDefault(slog.New(requestIdHandler{handler}).With("service", "cell", "cell", cellIdFromHostname()))
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// probes and scrapes come every few seconds and say nothing interesting
+var quietRoutes = map[string]bool{"/healthcheck": true, "/metrics": true}
+
+// logRequests is mux middleware taking the request id from the caller, or
+// making one up, and logging each request once answered. The path is left
+// out since the REST API carries values in it.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIdHeader)
+		if id == "" {
+			id = newRequestId()
+		}
+		w.Header().Set(RequestIdHeader, id)
+		r = r.WithContext(withRequestId(r.Context(), id))
+		route := ""
+		if current := mux.CurrentRoute(r); current != nil {
+			route, _ = current.GetPathTemplate()
+		}
+		start := time.Now()
+		recorder := &statusRecorder{w, http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		level := slog.LevelInfo
+		if recorder.status >= 500 {
+			level = slog.LevelWarn
+		} else if quietRoutes[route] {
+			level = slog.LevelDebug
+		}
+		slog.Log(r.Context(), level, "request", "method", r.Method, "route", route, "key", mux.Vars(r)["id"],
+			"status", recorder.status, "duration", time.Since(start))
+	})
+}
+
+// grpcRequestContext takes the request id out of the incoming metadata
+func grpcRequestContext(ctx context.Context) context.Context {
+	id := ""
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(requestIdMetadata); len(values) > 0 {
+			id = values[0]
+		}
+	}
+	if id == "" {
+		id = newRequestId()
+	}
+	return withRequestId(ctx, id)
+}
+
+func logGRPC(ctx context.Context, method string, start time.Time, err error) {
+	level := slog.LevelInfo
+	code := status.Code(err)
+	if code == codes.Internal || code == codes.DataLoss || code == codes.Unknown {
+		level = slog.LevelWarn
+	} else if method == Cell_Health_FullMethodName || method == Cell_Info_FullMethodName {
+		level = slog.LevelDebug
+	}
+	slog.Log(ctx, level, "grpc request", "method", method, "code", code.String(), "duration", time.Since(start))
+}
+
+func requestIdUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	ctx = grpcRequestContext(ctx)
+	start := time.Now()
+	res, err := handler(ctx, req)
+	logGRPC(ctx, info.FullMethod, start, err)
+	return res, err
+}
+
+// requestIdServerStream hands the handler a context with the request id in it
+type requestIdServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s requestIdServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func requestIdStream(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx := grpcRequestContext(stream.Context())
+	start := time.Now()
+	err := handler(srv, requestIdServerStream{stream, ctx})
+	logGRPC(ctx, info.FullMethod, start, err)
+	return err
+}
+
+// TLS
+
+// With TLS_CERT and TLS_KEY set both APIs are served over TLS, and callers
+// must show a client certificate that chains to TLS_CA and is issued to
+// CONTROLLER_TLS_NAME, in a DNS name or the common name: the controller's.
+// The cells' own certificates chain to the same CA more often than not, so
+// the name is what keeps one cell from calling another as the controller.
+// Only the REST routes in publicRoutes, for probes and scrapes, can still
+// be had without one. The files are meant to be a mounted secret; they are
+// looked at every certReloadInterval and read again when they change, so
+// rotating them needs no restart.
+
+const certReloadInterval = 30 * time.Second
+
+var cellTLS *certReloader
+
+var publicRoutes = map[string]bool{"/healthcheck": true, "/metrics": true, "/openapi.json": true}
+
+type certReloader struct {
+	certFile   string
+	keyFile    string
+	caFile     string
+	clientName string
+
+	lock     sync.RWMutex
+	cert     *tls.Certificate
+	roots    *x509.CertPool
+	modified time.Time
+}
+
+func newCertReloader(certFile string, keyFile string, caFile string, clientName string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile, caFile: caFile, clientName: clientName}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	go c.watch()
+	return c, nil
+}
+
+// lastModified is when the newest of the files was written
+func (c *certReloader) lastModified() time.Time {
+	var last time.Time
+	for _, name := range []string{c.certFile, c.keyFile, c.caFile} {
+		if info, err := os.Stat(name); err == nil && info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+	}
+	return last
+}
+
+func (c *certReloader) load() error {
+	modified := c.lastModified()
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	pem, err := os.ReadFile(c.caFile)
+	if err != nil {
+		return err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem) {
+		return errors.New("no certificates in " + c.caFile)
+	}
+	c.lock.Lock()
+	c.cert, c.roots, c.modified = &cert, roots, modified
+	c.lock.Unlock()
+	return nil
+}
+
+// watch reloads the files when they change; if they cannot be read, half
+// written say, the ones loaded before stay in use
+func (c *certReloader) watch() {
+	for range time.Tick(certReloadInterval) {
+		c.lock.RLock()
+		modified := c.modified
+		c.lock.RUnlock()
+		if !c.lastModified().After(modified) {
+			continue
+		}
+		if err := c.load(); err != nil {
+			slog.Error("could not reload TLS certificates", "error", err)
+			continue
+		}
+		slog.Info("TLS certificates reloaded", "cert", c.certFile)
+	}
+}
+
+// serverConfig checks client certificates against the CA loaded last by
+// hand, rather than through ClientCAs, so that a new CA is used on the
+// next handshake. With tls.RequestClientCert a caller may show none.
+// Whatever it shows must also name the controller.
+func (c *certReloader) serverConfig(clientAuth tls.ClientAuthType) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ClientAuth: clientAuth,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			c.lock.RLock()
+			defer c.lock.RUnlock()
+			return c.cert, nil
+		},
+		VerifyConnection: func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return nil
+			}
+			c.lock.RLock()
+			roots := c.roots
+			c.lock.RUnlock()
+			intermediates := x509.NewCertPool()
+			for _, cert := range state.PeerCertificates[1:] {
+				intermediates.AddCert(cert)
+			}
+			leaf := state.PeerCertificates[0]
+			_, err := leaf.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates,
+				KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+			if err != nil {
+				return err
+			}
+			if leaf.Subject.CommonName != c.clientName && leaf.VerifyHostname(c.clientName) != nil {
+				return errors.New("client certificate is not issued to " + c.clientName)
+			}
+			return nil
+		},
+	}
+}
+
+// requireClientCert is mux middleware turning away REST requests that came
+// without a client certificate, but for the public routes. Those that came
+// with a bad one never got past the handshake.
+func requireClientCert(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := ""
+		if current := mux.CurrentRoute(r); current != nil {
+			route, _ = current.GetPathTemplate()
+		}
+		if cellTLS != nil && !publicRoutes[route] && (r.TLS == nil || len(r.TLS.PeerCertificates) == 0) {
+			JSONError(w, r, http.StatusUnauthorized, ErrCodeUnauthorized, "a client certificate is needed")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Tracing
+
+// Spans go where OTEL_TRACES_EXPORTER says, as in the controller: "otlp"
+// for a collector at OTEL_EXPORTER_OTLP_ENDPOINT, "console" for stdout, or
+// nowhere. The controller's trace context comes in the traceparent header
+// or gRPC metadata, so the cell's spans hang off the controller's.
+
+var tracer = otel.Tracer("k8s-elastic-storage/cell")
+
+func setupTracing() error {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch strings.ToLower(os.Getenv("OTEL_TRACES_EXPORTER")) {
+	case "otlp":
+		exporter, err = otlptracegrpc.New(context.Background())
+	case "console", "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	res, err := resource.New(context.Background(),
+		resource.WithAttributes(semconv.ServiceName("cell"), attribute.Int("eks.cell", CellId)),
+		resource.WithFromEnv(), resource.WithTelemetrySDK())
+	if err != nil {
+		return err
+	}
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res)))
+	return nil
+}
+
+// traceRequests starts a server span for each REST request, named after
+// its route. Not otelhttp, which would put the path, and so the value, in
+// the span.
+func traceRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := ""
+		if current := mux.CurrentRoute(r); current != nil {
+			route, _ = current.GetPathTemplate()
+		}
+		if quietRoutes[route] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method+" "+route, trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(attribute.String("http.request.method", r.Method), attribute.String("http.route", route),
+				attribute.String("eks.key", mux.Vars(r)["id"])))
+		defer span.End()
+		recorder := &statusRecorder{w, http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+		span.SetAttributes(attribute.Int("http.response.status_code", recorder.status))
+		if recorder.status >= 500 {
+			span.SetStatus(otelcodes.Error, http.StatusText(recorder.status))
+		}
+	})
+}
+
+// cellIdFromHostname takes the ordinal the stateful set gave this pod
+func cellIdFromHostname() int {
+	hostname, _ := os.Hostname()
+	ordinal, err := strconv.Atoi(hostname[strings.LastIndex(hostname, "-")+1:])
+	if err != nil {
+		return -1
+	}
+	return ordinal
+}
+
 func Initialize(w http.ResponseWriter, r *http.Request) {
 	//keyStore.Initialize()
 }
 
 func main() {
 
+	setupLogging()
+
 	CellPort = os.Getenv("PORT")
 	if CellPort == "" {
 		CellPort = "7777"
 	}
 
+	CellGrpcPort = os.Getenv("GRPC_PORT")
+	if CellGrpcPort == "" {
+		CellGrpcPort = "7778"
+	}
+
 	CellDataPath = os.Getenv("DATAPATH")
 	if CellDataPath == "" {
 		CellDataPath = "/data"
 	}
 
+	ControllerURL = os.Getenv("CONTROLLER_URL")
+	if ControllerURL == "" {
+		ControllerURL = "http://k8s-elastic-storage-service:2222"
+	}
+	ControllerAPIKey = os.Getenv("CONTROLLER_API_KEY")
+
+	if certFile := os.Getenv("TLS_CERT"); certFile != "" {
+		controllerName := os.Getenv("CONTROLLER_TLS_NAME")
+		if controllerName == "" {
+			slog.Error("CONTROLLER_TLS_NAME not set, any certificate from TLS_CA would pass for the controller's")
+			os.Exit(1)
+		}
+		reloader, err := newCertReloader(certFile, os.Getenv("TLS_KEY"), os.Getenv("TLS_CA"), controllerName)
+		if err != nil {
+			slog.Error("could not load the TLS certificates", "error", err)
+			os.Exit(1)
+		}
+		cellTLS = reloader
+	} else {
+		slog.Warn("TLS_CERT not set, serving in plaintext to anyone")
+	}
+
+	CellId = cellIdFromHostname()
+
 	keyStore = new(KeyStore)
-	keyStore.Initialize() // cambiar a restore from file
+	keyStore.Initialize()
+	if err := RestoreKeyValues(keyStore); err != nil {
+		slog.Error("could not restore", "path", CellDataPath, "error", err)
+	}
+
+	scrubInterval, err := strconv.Atoi(os.Getenv("SCRUB_INTERVAL"))
+	if err != nil {
+		scrubInterval = 3600
+	}
+	scrubPause, err := strconv.Atoi(os.Getenv("SCRUB_PAUSE_MS"))
+	if err != nil {
+		scrubPause = 100
+	}
+	if scrubInterval > 0 {
+		go Scrub(time.Duration(scrubInterval)*time.Second, time.Duration(scrubPause)*time.Millisecond)
+	}
+
+	registerMetrics()
+	if err := setupTracing(); err != nil {
+		slog.Error("could not set up tracing", "error", err)
+	}
+
+	go ServeGRPC(CellGrpcPort)
+
 	r := mux.NewRouter()
+	r.Use(traceRequests)
+	r.Use(logRequests)
+	r.Use(requireClientCert)
 	r.HandleFunc("/cellinfo", ReportCellInfo).Methods("GET")
 	r.HandleFunc("/healthcheck", HealthCheck).Methods("GET")
+	r.HandleFunc("/openapi.json", OpenAPISpec).Methods("GET")
+	r.Handle("/metrics", promhttp.Handler()).Methods("GET")
 	r.HandleFunc("/initialize", Initialize).Methods("GET")
 	r.HandleFunc("/contents", ListStore).Methods("GET")
 	r.HandleFunc("/contains/{id}/{info}", Contains).Methods("GET")
 	r.HandleFunc("/{id}/{info}", StoreItem).Methods("POST")
 	r.HandleFunc("/{id}/{info}", DeleteItem).Methods("DELETE")
-	r.HandleFunc("{id}/{info}", UpdateItem).Methods("PUT")
+	r.HandleFunc("/{id}/{info}", UpdateItem).Methods("PUT")
 	r.HandleFunc("/{id}/{info}", RetrieveItem).Methods("GET")
-	fmt.Println("Storage cell started at port " + CellPort)
-	if err := http.ListenAndServe(":" + CellPort, r); err != nil {
-                log.Fatal(err)
-        }
+	slog.Info("storage cell started", "port", CellPort, "tls", cellTLS != nil)
+	if cellTLS != nil {
+		server := &http.Server{Addr: ":" + CellPort, Handler: r, TLSConfig: cellTLS.serverConfig(tls.RequestClientCert)}
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = http.ListenAndServe(":" + CellPort, r)
+	}
+	if err != nil {
+		slog.Error("REST API stopped", "error", err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,605 @@
+// Package client talks to the elastic storage controller's REST API, as
+// described in controller/openapi.json.
+//
+//	c := client.New("http://k8s-elastic-storage-service:2222")
+//	_, err := c.Store(ctx, "greeting", "hello", nil)
+//	obj, err := c.Retrieve(ctx, "greeting")
+//	if client.IsNotFound(err) { ... }
+//
+// Paths and values travel in the URL, one path segment each, so neither may
+// contain a slash.
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Error codes, as found in Error.Code
+const (
+	CodeBadRequest          = "bad_request"
+	CodeChecksumMismatch    = "checksum_mismatch"
+	CodeNotFound            = "not_found"
+	CodeConflict            = "conflict"
+	CodeInsufficientStorage = "insufficient_storage"
+	CodeQuotaExceeded       = "quota_exceeded"
+	CodeUnauthorized        = "unauthorized"
+	CodeForbidden           = "forbidden"
+	CodeUnavailable         = "unavailable"
+	CodeInternal            = "internal"
+)
+
+// Error is an error response from the controller. RetryAfter is set when a
+// store was turned away because no cell had room yet.
+type Error struct {
+	StatusCode int           `json:"-"`
+	Code       string        `json:"code"`
+	Message    string        `json:"message"`
+	RequestId  string        `json:"requestid"`
+	RetryAfter time.Duration `json:"-"`
+}
+
+func (e *Error) Error() string {
+	return "storage: " + e.Code + " (" + strconv.Itoa(e.StatusCode) + "): " + e.Message
+}
+
+func hasCode(err error, code string) bool {
+	var apiErr *Error
+	return errors.As(err, &apiErr) && apiErr.Code == code
+}
+
+func IsNotFound(err error) bool {
+	return hasCode(err, CodeNotFound)
+}
+
+func IsConflict(err error) bool {
+	return hasCode(err, CodeConflict)
+}
+
+func IsInsufficientStorage(err error) bool {
+	return hasCode(err, CodeInsufficientStorage)
+}
+
+// IsQuotaExceeded is true when a write would take the category over its
+// quota; it stays refused until something is deleted or the quota raised
+func IsQuotaExceeded(err error) bool {
+	return hasCode(err, CodeQuotaExceeded)
+}
+
+// IsUnauthorized is true when the client has no API key, or one the
+// controller does not know or has revoked: see WithAPIKey
+func IsUnauthorized(err error) bool {
+	return hasCode(err, CodeUnauthorized)
+}
+
+// IsForbidden is true when the API key lacks the permission, or the
+// category, the request needs
+func IsForbidden(err error) bool {
+	return hasCode(err, CodeForbidden)
+}
+
+// IsTemporary is true for errors that may go away if the request is made
+// again later
+func IsTemporary(err error) bool {
+	return hasCode(err, CodeUnavailable) || hasCode(err, CodeInsufficientStorage)
+}
+
+// ErrInvalidPath is returned, without making a request, for paths or
+// values the controller's routes cannot carry
+var ErrInvalidPath = errors.New("storage: paths and values must be non-empty and must not contain '/'")
+
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	apiKey     string
+}
+
+type Option func(*Client)
+
+// WithHTTPClient replaces the default client, which has a 30 second timeout
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithAPIKey sends key, as issued by POST /admin/keys, with every request
+func WithAPIKey(key string) Option {
+	return func(c *Client) {
+		c.apiKey = key
+	}
+}
+
+func New(baseURL string, options ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+	for _, option := range options {
+		option(c)
+	}
+	return c
+}
+
+// StoreOptions are all optional
+type StoreOptions struct {
+	// Overwrite replaces an existing object instead of failing with a conflict
+	Overwrite bool
+	// CreateOnly fails with a conflict if the object exists, even in a
+	// versioned category
+	CreateOnly  bool
+	ContentType string
+	// Encoding records how value is encoded, e.g. "base64url"; it is stored
+	// as given and comes back in Object.Encoding
+	Encoding string
+	Metadata map[string]string
+}
+
+type StoreResult struct {
+	Bytes    int64  `json:"bytes"`
+	Version  int64  `json:"version"`
+	Checksum string `json:"-"`
+}
+
+type Object struct {
+	Path        string
+	Value       string
+	Size        int64
+	Version     int64
+	Checksum    string
+	ContentType string
+	Encoding    string
+	Metadata    map[string]string
+	Created     time.Time
+	Modified    time.Time
+}
+
+type ObjectInfo struct {
+	Path        string            `json:"path"`
+	Size        int64             `json:"size"`
+	Version     int64             `json:"version"`
+	Checksum    string            `json:"checksum"`
+	ContentType string            `json:"contenttype"`
+	Encoding    string            `json:"encoding"`
+	Metadata    map[string]string `json:"metadata"`
+	Created     time.Time         `json:"created"`
+	Modified    time.Time         `json:"modified"`
+}
+
+type ListOptions struct {
+	Prefix    string
+	Delimiter string
+	// Limit defaults to, and is capped at, 1000 by the controller
+	Limit int
+	// Continuation is Listing.Continuation from the previous page
+	Continuation string
+}
+
+type Listing struct {
+	Objects        []ObjectInfo `json:"objects"`
+	CommonPrefixes []string     `json:"commonprefixes"`
+	Truncated      bool         `json:"truncated"`
+	Continuation   string       `json:"continuation"`
+}
+
+type Status struct {
+	Revision int `json:"revision"`
+	// State is "idle", "scaling up", "draining", "scaling down" or "rebalancing"
+	State               string       `json:"state"`
+	CellsAlive          int          `json:"cells-alive"`
+	NumberOfCells       int          `json:"numberofcells"`
+	TotalSpace          int64        `json:"totalspace"`
+	UsedSpace           int64        `json:"usedspace"`
+	ScaleUpThreshold    int64        `json:"suthreshold"`
+	ScaleDownThreshold  int64        `json:"sdthreshold"`
+	ChecksumMismatches  int64        `json:"checksummismatches"`
+	CorruptionsReported int64        `json:"corruptionsreported"`
+	OpenCircuits        []int        `json:"opencircuits"`
+	Cells               []CellStatus `json:"cells"`
+	// LastOperation is nil until the controller has scaled or rebalanced
+	LastOperation *Operation `json:"lastoperation"`
+}
+
+type CellStatus struct {
+	CellId    int   `json:"cellid"`
+	Capacity  int64 `json:"capacity"`
+	FreeSpace int64 `json:"freespace"`
+	Objects   int64 `json:"objects"`
+	// Healthy and LastSeen are as of the controller's last health check
+	Healthy     bool       `json:"healthy"`
+	LastSeen    *time.Time `json:"lastseen"`
+	LastError   string     `json:"lasterror"`
+	CircuitOpen bool       `json:"circuitopen"`
+}
+
+type Operation struct {
+	// Name is "scaleup", "drain", "scaledown" or "rebalance"
+	Name     string     `json:"name"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished"`
+	// Result is "running", "ok", "failed" or "cancelled"
+	Result string `json:"result"`
+	Error  string `json:"error"`
+	// Skipped counts keys a drain or rebalance found were no longer where
+	// the cell listing said, and left alone
+	Skipped int `json:"skipped"`
+}
+
+// Checksum is what the controller uses for ETags and X-Checksum-Sha256:
+// the hex SHA-256 of the value
+func Checksum(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+func validSegment(segment string) bool {
+	return segment != "" && !strings.Contains(segment, "/")
+}
+
+func objectURL(path string, value string) string {
+	return "/" + url.PathEscape(path) + "/" + url.PathEscape(value)
+}
+
+// do makes the request and decodes a 200 answer into out, if out is not
+// nil; anything else becomes an *Error
+func (c *Client) do(ctx context.Context, method string, path string, header http.Header, out interface{}) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resp, decodeError(resp)
+	}
+	if out != nil {
+		if err = json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp, errors.New("storage: bad response: " + err.Error())
+		}
+	}
+	return resp, nil
+}
+
+func decodeError(resp *http.Response) error {
+	apiErr := &Error{StatusCode: resp.StatusCode, Code: CodeInternal, Message: resp.Status}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	var envelope struct {
+		Error *Error `json:"error"`
+	}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		apiErr.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	if json.Unmarshal(body, &envelope) == nil && envelope.Error != nil {
+		envelope.Error.StatusCode = resp.StatusCode
+		envelope.Error.RetryAfter = apiErr.RetryAfter
+		return envelope.Error
+	}
+	// no body for HEAD, or something in between that is not the controller
+	switch resp.StatusCode {
+	case http.StatusBadRequest:
+		apiErr.Code = CodeBadRequest
+	case http.StatusNotFound:
+		apiErr.Code = CodeNotFound
+	case http.StatusConflict:
+		apiErr.Code = CodeConflict
+	case http.StatusInsufficientStorage:
+		apiErr.Code = CodeInsufficientStorage
+	case http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusGatewayTimeout:
+		apiErr.Code = CodeUnavailable
+	}
+	apiErr.RequestId = resp.Header.Get("X-Request-Id")
+	return apiErr
+}
+
+func writeHeader(value string, opts *StoreOptions) http.Header {
+	header := http.Header{}
+	header.Set("X-Checksum-Sha256", Checksum(value))
+	if opts.ContentType != "" {
+		header.Set("Content-Type", opts.ContentType)
+	}
+	if opts.Encoding != "" {
+		header.Set("X-Object-Encoding", opts.Encoding)
+	}
+	for name, value := range opts.Metadata {
+		header.Set("X-Meta-"+name, value)
+	}
+	return header
+}
+
+// Store creates an object. What happens when it already exists depends on
+// opts and on whether the category keeps versions: see StoreOptions.
+func (c *Client) Store(ctx context.Context, path string, value string, opts *StoreOptions) (*StoreResult, error) {
+	if !validSegment(path) || !validSegment(value) {
+		return nil, ErrInvalidPath
+	}
+	if opts == nil {
+		opts = &StoreOptions{}
+	}
+	header := writeHeader(value, opts)
+	target := objectURL(path, value)
+	if opts.CreateOnly {
+		header.Set("If-None-Match", "*")
+	} else if opts.Overwrite {
+		target += "?overwrite=true"
+	}
+	result := new(StoreResult)
+	resp, err := c.do(ctx, "POST", target, header, result)
+	if err != nil {
+		return nil, err
+	}
+	result.Checksum = strings.Trim(resp.Header.Get("ETag"), "\"")
+	return result, nil
+}
+
+// Update replaces an existing object
+func (c *Client) Update(ctx context.Context, path string, value string, opts *StoreOptions) (*StoreResult, error) {
+	if !validSegment(path) || !validSegment(value) {
+		return nil, ErrInvalidPath
+	}
+	if opts == nil {
+		opts = &StoreOptions{}
+	}
+	result := new(StoreResult)
+	resp, err := c.do(ctx, "PUT", objectURL(path, value), writeHeader(value, opts), result)
+	if err != nil {
+		return nil, err
+	}
+	result.Checksum = strings.Trim(resp.Header.Get("ETag"), "\"")
+	return result, nil
+}
+
+// Retrieve returns the current version of an object
+func (c *Client) Retrieve(ctx context.Context, path string) (*Object, error) {
+	return c.retrieve(ctx, path, "")
+}
+
+func (c *Client) RetrieveVersion(ctx context.Context, path string, version int64) (*Object, error) {
+	return c.retrieve(ctx, path, "?version="+strconv.FormatInt(version, 10))
+}
+
+func (c *Client) retrieve(ctx context.Context, path string, query string) (*Object, error) {
+	if !validSegment(path) {
+		return nil, ErrInvalidPath
+	}
+	var body struct {
+		Result struct {
+			Value    string `json:"value"`
+			Checksum string `json:"checksum"`
+		} `json:"result"`
+	}
+	resp, err := c.do(ctx, "GET", objectURL(path, "_")+query, nil, &body)
+	if err != nil {
+		return nil, err
+	}
+	obj := objectFromHeaders(path, resp.Header)
+	obj.Value = body.Result.Value
+	if Checksum(obj.Value) != obj.Checksum && obj.Checksum != "" {
+		return nil, &Error{StatusCode: resp.StatusCode, Code: CodeChecksumMismatch,
+			Message: "value does not match its checksum", RequestId: resp.Header.Get("X-Request-Id")}
+	}
+	return obj, nil
+}
+
+// Head returns an object's metadata without its value
+func (c *Client) Head(ctx context.Context, path string) (*Object, error) {
+	if !validSegment(path) {
+		return nil, ErrInvalidPath
+	}
+	resp, err := c.do(ctx, "HEAD", objectURL(path, "_"), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return objectFromHeaders(path, resp.Header), nil
+}
+
+func objectFromHeaders(path string, header http.Header) *Object {
+	obj := &Object{
+		Path:        path,
+		Checksum:    strings.Trim(header.Get("ETag"), "\""),
+		ContentType: header.Get("X-Object-Content-Type"),
+		Encoding:    header.Get("X-Object-Encoding"),
+	}
+	obj.Size, _ = strconv.ParseInt(header.Get("X-Object-Size"), 10, 64)
+	obj.Version, _ = strconv.ParseInt(header.Get("X-Object-Version"), 10, 64)
+	obj.Created, _ = http.ParseTime(header.Get("X-Object-Created"))
+	obj.Modified, _ = http.ParseTime(header.Get("Last-Modified"))
+	for name, values := range header {
+		if strings.HasPrefix(name, "X-Meta-") && len(values) > 0 {
+			if obj.Metadata == nil {
+				obj.Metadata = make(map[string]string)
+			}
+			obj.Metadata[strings.ToLower(strings.TrimPrefix(name, "X-Meta-"))] = values[0]
+		}
+	}
+	return obj
+}
+
+// Delete removes an object; in a versioned category it leaves a tombstone
+func (c *Client) Delete(ctx context.Context, path string) error {
+	if !validSegment(path) {
+		return ErrInvalidPath
+	}
+	_, err := c.do(ctx, "DELETE", objectURL(path, "_"), nil, nil)
+	return err
+}
+
+// DeleteVersion purges one version of an object for good
+func (c *Client) DeleteVersion(ctx context.Context, path string, version int64) error {
+	if !validSegment(path) {
+		return ErrInvalidPath
+	}
+	_, err := c.do(ctx, "DELETE", objectURL(path, "_")+"?version="+strconv.FormatInt(version, 10), nil, nil)
+	return err
+}
+
+// List returns one page of objects; pass Listing.Continuation back in
+// ListOptions for the next one while Listing.Truncated is set
+func (c *Client) List(ctx context.Context, opts ListOptions) (*Listing, error) {
+	query := url.Values{}
+	if opts.Prefix != "" {
+		query.Set("prefix", opts.Prefix)
+	}
+	if opts.Delimiter != "" {
+		query.Set("delimiter", opts.Delimiter)
+	}
+	if opts.Limit > 0 {
+		query.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if opts.Continuation != "" {
+		query.Set("continuation", opts.Continuation)
+	}
+	var body struct {
+		Result Listing `json:"result"`
+	}
+	_, err := c.do(ctx, "GET", "/objects?"+query.Encode(), nil, &body)
+	if err != nil {
+		return nil, err
+	}
+	return &body.Result, nil
+}
+
+func (c *Client) Status(ctx context.Context) (*Status, error) {
+	status := new(Status)
+	_, err := c.do(ctx, "GET", "/status", nil, status)
+	if err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// The admin calls need a key with admin permission; Usage, ListKeys,
+// IssueKey, RevokeKey, Fsck, Drain and Rebalance need it on all categories.
+
+type CategoryUsage struct {
+	Category  string `json:"category"`
+	UsedBytes int64  `json:"usedbytes"`
+	Objects   int64  `json:"objects"`
+	// MaxBytes and MaxObjects are the category's quota, 0 for none
+	MaxBytes   int64 `json:"maxbytes"`
+	MaxObjects int64 `json:"maxobjects"`
+}
+
+type APIKey struct {
+	Id          string     `json:"id"`
+	Name        string     `json:"name"`
+	Permissions []string   `json:"permissions"`
+	Categories  []string   `json:"categories"`
+	Created     time.Time  `json:"created"`
+	Revoked     *time.Time `json:"revoked,omitempty"`
+	// Key is only there in what IssueKey returns
+	Key string `json:"key,omitempty"`
+}
+
+type FsckItem struct {
+	Category string `json:"category"`
+	Path     string `json:"path"`
+	Key      string `json:"key"`
+	Size     int64  `json:"size"`
+	CellId   int    `json:"cellid"`
+}
+
+type FsckReport struct {
+	Repair           bool            `json:"repair"`
+	CellsChecked     int             `json:"cellschecked"`
+	UnreachableCells []int           `json:"unreachablecells"`
+	Orphans          []FsckItem      `json:"orphans"`
+	Dangling         []FsckItem      `json:"dangling"`
+	Categories       []CategoryUsage `json:"categories"`
+	UsedSpace        int64           `json:"usedspace"`
+	TotalSpace       int64           `json:"totalspace"`
+	Errors           []string        `json:"errors"`
+}
+
+// Usage returns what each category stores, with its quota
+func (c *Client) Usage(ctx context.Context) ([]CategoryUsage, error) {
+	var body struct {
+		Result []CategoryUsage `json:"result"`
+	}
+	if _, err := c.do(ctx, "GET", "/admin/usage", nil, &body); err != nil {
+		return nil, err
+	}
+	return body.Result, nil
+}
+
+func (c *Client) ListKeys(ctx context.Context) ([]APIKey, error) {
+	var body struct {
+		Result []APIKey `json:"result"`
+	}
+	if _, err := c.do(ctx, "GET", "/admin/keys", nil, &body); err != nil {
+		return nil, err
+	}
+	return body.Result, nil
+}
+
+// IssueKey returns the new key with its Key set, the only time it is known
+func (c *Client) IssueKey(ctx context.Context, name string, permissions []string, categories []string) (*APIKey, error) {
+	query := url.Values{}
+	query.Set("name", name)
+	query.Set("permissions", strings.Join(permissions, ","))
+	query.Set("categories", strings.Join(categories, ","))
+	var body struct {
+		Result APIKey `json:"result"`
+	}
+	if _, err := c.do(ctx, "POST", "/admin/keys?"+query.Encode(), nil, &body); err != nil {
+		return nil, err
+	}
+	return &body.Result, nil
+}
+
+func (c *Client) RevokeKey(ctx context.Context, id string) error {
+	_, err := c.do(ctx, "DELETE", "/admin/keys/"+url.PathEscape(id), nil, nil)
+	return err
+}
+
+// Fsck checks the directory against what the cells hold, and with repair
+// set fixes what it finds. It takes a while on a big store, longer than
+// the default client's timeout.
+func (c *Client) Fsck(ctx context.Context, repair bool) (*FsckReport, error) {
+	var body struct {
+		Result FsckReport `json:"result"`
+	}
+	if _, err := c.do(ctx, "POST", "/admin/fsck?repair="+strconv.FormatBool(repair), nil, &body); err != nil {
+		return nil, err
+	}
+	return &body.Result, nil
+}
+
+// Drain starts moving everything off the last cell to remove it, and
+// returns what the controller says it is doing; Status follows it
+func (c *Client) Drain(ctx context.Context) (string, error) {
+	return c.trigger(ctx, "/admin/drain")
+}
+
+// Rebalance starts moving objects from the fullest cells to the emptiest,
+// and returns what the controller says it is doing; Status follows it
+func (c *Client) Rebalance(ctx context.Context) (string, error) {
+	return c.trigger(ctx, "/admin/rebalance")
+}
+
+func (c *Client) trigger(ctx context.Context, path string) (string, error) {
+	var body struct {
+		Result string `json:"result"`
+	}
+	if _, err := c.do(ctx, "POST", path, nil, &body); err != nil {
+		return "", err
+	}
+	return body.Result, nil
+}
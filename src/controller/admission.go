@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+//																														//
+// Admission control																									//
+//																														//
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+// A store that finds no cell with room for it is not failed outright while
+// a scale up can fix that. It waits for the room to appear, up to
+// ADMISSION_MAX_WAIT seconds (not at all by default) or less if the caller
+// sends "Prefer: wait=N", and is then turned away with 503 and a
+// Retry-After of when the scale up should be done. Only a value bigger than
+// a whole cell gets 507, since no scale up will ever make room for it.
+//
+// The room a store needs is reserved in cellstatus when its cell is picked,
+// and given back once the store is committed or has failed; see
+// reserveFreeSpace.
+
+var admissionMaxWait time.Duration
+
+// until a scale up has been timed, this is how long one is taken to last
+const defaultScaleUpEstimate = 60 * time.Second
+
+const minRetryAfter = time.Second
+
+var scaleUpEstimate = defaultScaleUpEstimate
+var scaleUpEstimateLock sync.Mutex
+
+// capacityArrived is closed, and replaced, whenever a scale up finishes
+var capacityArrived = make(chan struct{})
+var capacityArrivedLock sync.Mutex
+
+// capacityError turns a store away until Retry-After
+type capacityError struct {
+	retryAfter time.Duration
+}
+
+func (e *capacityError) Error() string {
+	return "no cell has room yet, retry in " + strconv.Itoa(retryAfterSeconds(e.retryAfter)) + " seconds"
+}
+
+func retryAfterSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
+
+// retryAfterFrom tells whether err comes with a time to retry at
+func retryAfterFrom(err error) (time.Duration, bool) {
+	var capacity *capacityError
+	if errors.As(err, &capacity) {
+		return capacity.retryAfter, true
+	}
+	return 0, false
+}
+
+func setupAdmission() {
+	seconds, err := strconv.Atoi(os.Getenv("ADMISSION_MAX_WAIT"))
+	if err == nil && seconds > 0 {
+		admissionMaxWait = time.Duration(seconds) * time.Second
+	}
+}
+
+type admissionWaitKey struct{}
+
+// preferWait is mux middleware putting how long a store may wait for room
+// in the request's context: ADMISSION_MAX_WAIT, or the caller's
+// "Prefer: wait=N" (RFC 7240) if that is shorter
+func preferWait(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wait := admissionMaxWait
+		for _, preference := range strings.Split(r.Header.Get("Prefer"), ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(preference), "=")
+			if strings.ToLower(name) != "wait" {
+				continue
+			}
+			if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 && time.Duration(seconds)*time.Second < wait {
+				wait = time.Duration(seconds) * time.Second
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), admissionWaitKey{}, wait)))
+	})
+}
+
+// admissionWaitFrom is zero for work that did not come in over HTTP
+func admissionWaitFrom(ctx context.Context) time.Duration {
+	wait, _ := ctx.Value(admissionWaitKey{}).(time.Duration)
+	return wait
+}
+
+// reserveSpace picks a cell with room for size bytes and holds the room
+// until release is called, which should be once the store is committed or
+// has failed. The cell is -1, and release does nothing, if none has room.
+func reserveSpace(ctx context.Context, conn *DBConnectionContext, size int64) (int, func()) {
+	cellid := reserveFreeSpace(ctx, conn, size)
+	if cellid == -1 {
+		return -1, func() {}
+	}
+	return cellid, reservation(ctx, conn, cellid, size)
+}
+
+// reserveSpaceOn holds size more bytes on a given cell, if it has them
+func reserveSpaceOn(ctx context.Context, conn *DBConnectionContext, cellid int, size int64) (bool, func(), error) {
+	if size <= 0 {
+		return true, func() {}, nil
+	}
+	reserved, err := reserveFreeSpaceOn(ctx, conn, cellid, size)
+	if err != nil || !reserved {
+		return false, func() {}, err
+	}
+	return true, reservation(ctx, conn, cellid, size), nil
+}
+
+// reservation returns the function giving back size bytes reserved on a
+// cell; calling it again does nothing
+func reservation(ctx context.Context, conn *DBConnectionContext, cellid int, size int64) func() {
+	ctx = context.WithoutCancel(ctx)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			if err := releaseFreeSpace(ctx, conn, cellid, size); err != nil {
+				// it stays reserved until the controller restarts
+				slog.ErrorContext(ctx, "could not release reserved space", "cell", cellid, "size", size, "error", err)
+			}
+		})
+	}
+}
+
+// admitStore reserves room for a store of size bytes, waiting for a scale
+// up to provide it if the request allows. operation labels the rejection
+// in the metrics.
+func admitStore(ctx context.Context, conn *DBConnectionContext, size int64, operation string) (int, func(), error) {
+	if size > int64(cellCapacity) {
+		storeRejections.WithLabelValues(operation).Inc()
+		return -1, func() {}, errNoSpace
+	}
+	deadline := time.Now().Add(admissionWaitFrom(ctx))
+	waited := false
+	for {
+		cellid, release := reserveSpace(ctx, conn, size)
+		if cellid != -1 {
+			if waited {
+				slog.InfoContext(ctx, "room found after waiting", "size", size, "cell", cellid)
+			}
+			return cellid, release, nil
+		}
+		requestScaleUp(ctx, conn)
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			storeRejections.WithLabelValues(operation).Inc()
+			return -1, func() {}, &capacityError{expectedCapacityIn()}
+		}
+		if !waited {
+			slog.InfoContext(ctx, "no cell has room, waiting", "size", size, "wait", remaining)
+			waited = true
+		}
+		// deletes make room too, without saying so
+		poll := time.Second
+		if remaining < poll {
+			poll = remaining
+		}
+		select {
+		case <-capacitySignal():
+		case <-time.After(poll):
+		case <-ctx.Done():
+			storeRejections.WithLabelValues(operation).Inc()
+			return -1, func() {}, &capacityError{expectedCapacityIn()}
+		}
+	}
+}
+
+// requestScaleUp starts a scale up if nothing else is going on. It is not
+// CheckScaleUp: the total free space may be over the threshold with no
+// single cell having room for this one value.
+func requestScaleUp(ctx context.Context, conn *DBConnectionContext) {
+	if ServerState == SNAFU {
+		slog.InfoContext(ctx, "no cell has room, scaling up")
+		go ScaleUp(backgroundContext("scaleup"), conn)
+	}
+}
+
+func capacitySignal() <-chan struct{} {
+	capacityArrivedLock.Lock()
+	defer capacityArrivedLock.Unlock()
+	return capacityArrived
+}
+
+// scaleUpFinished wakes the stores waiting for room, and keeps a running
+// estimate of how long a scale up takes
+func scaleUpFinished(took time.Duration) {
+	scaleUpEstimateLock.Lock()
+	scaleUpEstimate = (scaleUpEstimate + took) / 2
+	scaleUpEstimateLock.Unlock()
+
+	capacityArrivedLock.Lock()
+	defer capacityArrivedLock.Unlock()
+	close(capacityArrived)
+	capacityArrived = make(chan struct{})
+}
+
+// expectedCapacityIn is how long until the scale up under way, or the one
+// just asked for, should be done
+func expectedCapacityIn() time.Duration {
+	scaleUpEstimateLock.Lock()
+	estimate := scaleUpEstimate
+	scaleUpEstimateLock.Unlock()
+	if operation := getLastOperation(); ServerState == ScalingUp && operation != nil && operation.Name == "scaleup" {
+		estimate = time.Until(operation.Started.Add(estimate))
+	}
+	if estimate < minRetryAfter {
+		estimate = minRetryAfter
+	}
+	return estimate
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+//																														//
+// Authentication																										//
+//																														//
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+// Every request on the REST API, but for /healthcheck, /metrics and
+// /openapi.json, has to carry an API key in "Authorization: Bearer <key>".
+// A key is "<id>.<secret>"; the apikeys collection keeps the id and a
+// SHA-256 of the secret, so the key itself is only ever seen when issued.
+//
+// A key has permissions, any of read, write and admin (which implies the
+// other two), over a list of categories, "*" meaning all of them. Objects
+// need read or write on their category; /admin/categories/{category} needs
+// admin on that category, and the rest of /admin needs admin on "*".
+//
+// ADMIN_API_KEY, if set, is a key with admin on "*" that is not in the
+// collection, to issue the first keys with. AUTH=off lets everything
+// through, as before there were keys. The S3 gateway signs with secrets
+// of its own, but each of its access key ids has to be the id of an API
+// key, whose permissions then apply there with buckets as categories.
+
+const (
+	PermissionRead  = "read"
+	PermissionWrite = "write"
+	PermissionAdmin = "admin"
+)
+
+const allCategories = "*"
+
+const (
+	ErrCodeUnauthorized = "unauthorized"
+	ErrCodeForbidden    = "forbidden"
+)
+
+type APIKey struct {
+	Id          string     `json:"id" bson:"_id"`
+	Name        string     `json:"name"`
+	Hash        string     `json:"-" bson:"hash"`
+	Permissions []string   `json:"permissions"`
+	Categories  []string   `json:"categories"`
+	Created     time.Time  `json:"created"`
+	Revoked     *time.Time `json:"revoked,omitempty"`
+}
+
+var authEnabled = true
+var bootstrapKey string
+
+func setupAuth(conn *DBConnectionContext) {
+	if strings.ToLower(os.Getenv("AUTH")) == "off" {
+		authEnabled = false
+		slog.Warn("authentication is off, anyone who can reach the API can do anything")
+		return
+	}
+	bootstrapKey = os.Getenv("ADMIN_API_KEY")
+	if bootstrapKey == "" {
+		keys, err := conn.apikeys.CountDocuments(context.TODO(), bson.D{{"revoked", nil}})
+		if err == nil && keys == 0 {
+			slog.Warn("no API keys issued and ADMIN_API_KEY not set, every request will be refused")
+		}
+	}
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(size int) string {
+	buffer := make([]byte, size)
+	rand.Read(buffer)
+	return hex.EncodeToString(buffer)
+}
+
+// issueAPIKey records a new key and returns it, the one time it is known
+func issueAPIKey(conn *DBConnectionContext, name string, permissions []string, categories []string) (string, APIKey, error) {
+	secret := randomHex(32)
+	key := APIKey{Id: randomHex(8), Name: name, Hash: hashSecret(secret), Permissions: permissions,
+		Categories: categories, Created: time.Now().UTC()}
+	_, err := conn.apikeys.InsertOne(context.TODO(), key)
+	return key.Id + "." + secret, key, err
+}
+
+func getAPIKeys(conn *DBConnectionContext) ([]APIKey, error) {
+	keys := []APIKey{}
+	cursor, err := conn.apikeys.Find(context.TODO(), bson.D{})
+	if err != nil {
+		return nil, err
+	}
+	err = cursor.All(context.TODO(), &keys)
+	return keys, err
+}
+
+// revokeAPIKey keeps the key's record, for the audit trail, but it no
+// longer lets anything through
+func revokeAPIKey(conn *DBConnectionContext, id string) error {
+	res, err := conn.apikeys.UpdateOne(context.TODO(), bson.D{{"_id", id}, {"revoked", nil}},
+		bson.D{{"$set", bson.D{{"revoked", time.Now().UTC()}}}})
+	if err == nil && res.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return err
+}
+
+// findAPIKey returns nil, and no error, for keys that are unknown, wrong
+// or revoked
+func findAPIKey(ctx context.Context, conn *DBConnectionContext, token string) (*APIKey, error) {
+	if bootstrapKey != "" && subtle.ConstantTimeCompare([]byte(token), []byte(bootstrapKey)) == 1 {
+		return &APIKey{Id: "bootstrap", Name: "ADMIN_API_KEY", Permissions: []string{PermissionAdmin}, Categories: []string{allCategories}}, nil
+	}
+	id, secret, found := strings.Cut(token, ".")
+	if !found {
+		return nil, nil
+	}
+	key, err := getActiveAPIKey(ctx, conn, id)
+	if key == nil || subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(key.Hash)) != 1 {
+		return nil, err
+	}
+	return key, nil
+}
+
+// getActiveAPIKey returns nil, and no error, if there is no key id or it
+// is revoked
+func getActiveAPIKey(ctx context.Context, conn *DBConnectionContext, id string) (*APIKey, error) {
+	var key APIKey
+	err := conn.apikeys.FindOne(ctx, bson.D{{"_id", id}}).Decode(&key)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if key.Revoked != nil {
+		return nil, nil
+	}
+	return &key, nil
+}
+
+// allows tells whether the key has permission on category; an empty
+// category is any category at all
+func (k *APIKey) allows(permission string, category string) bool {
+	if !slices.Contains(k.Permissions, permission) && !slices.Contains(k.Permissions, PermissionAdmin) {
+		return false
+	}
+	return category == "" || slices.Contains(k.Categories, allCategories) || slices.Contains(k.Categories, category)
+}
+
+var publicRoutes = map[string]bool{"/healthcheck": true, "/metrics": true, "/openapi.json": true}
+
+// requiredPermission is what a request to route needs, and on which
+// category. The object routes all work on the default category; the other
+// categories are only reached as buckets, through s3RequiredPermission.
+func requiredPermission(r *http.Request, route string) (string, string) {
+	switch {
+	case strings.HasPrefix(route, "/admin/"):
+		if category, exists := mux.Vars(r)["category"]; exists {
+			return PermissionAdmin, category
+		}
+		return PermissionAdmin, allCategories
+	case route == "/status":
+		return PermissionRead, ""
+	case strings.HasPrefix(route, "/get/"):
+		return PermissionRead, "default"
+	case strings.HasPrefix(route, "/post/"), strings.HasPrefix(route, "/update/"), strings.HasPrefix(route, "/delete/"):
+		return PermissionWrite, "default"
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		return PermissionRead, "default"
+	default:
+		return PermissionWrite, "default"
+	}
+}
+
+// authenticate is mux middleware refusing requests without a key that
+// allows them: 401 if there is no good key, 403 if it falls short
+func authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := ""
+		if current := mux.CurrentRoute(r); current != nil {
+			route, _ = current.GetPathTemplate()
+		}
+		if !authEnabled || publicRoutes[route] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || token == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="eks"`)
+			JSONError(w, r, http.StatusUnauthorized, ErrCodeUnauthorized, "an API key is needed")
+			return
+		}
+		key, err := findAPIKey(r.Context(), &dbConnectionContext, token)
+		if err != nil {
+			JSONErrorFrom(w, r, err)
+			return
+		}
+		if key == nil {
+			slog.InfoContext(r.Context(), "unknown or revoked API key")
+			w.Header().Set("WWW-Authenticate", `Bearer realm="eks", error="invalid_token"`)
+			JSONError(w, r, http.StatusUnauthorized, ErrCodeUnauthorized, "unknown or revoked API key")
+			return
+		}
+		trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("eks.api_key", key.Id))
+		permission, category := requiredPermission(r, route)
+		if !key.allows(permission, category) {
+			slog.InfoContext(r.Context(), "API key not allowed", "apikey", key.Id, "permission", permission, "category", category)
+			scope := "category " + category
+			if category == "" {
+				scope = "any category"
+			} else if category == allCategories {
+				scope = "all categories"
+			}
+			JSONError(w, r, http.StatusForbidden, ErrCodeForbidden, "this key has no "+permission+" permission on "+scope)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func IssueKey(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var permissions, categories []string
+	for _, permission := range strings.Split(query.Get("permissions"), ",") {
+		if permission != PermissionRead && permission != PermissionWrite && permission != PermissionAdmin {
+			JSONError(w, r, http.StatusBadRequest, ErrCodeBadRequest, "permissions must be read, write or admin")
+			return
+		}
+		permissions = append(permissions, permission)
+	}
+	for _, category := range strings.Split(query.Get("categories"), ",") {
+		if category == "" {
+			JSONError(w, r, http.StatusBadRequest, ErrCodeBadRequest, "categories must be given, * for all")
+			return
+		}
+		categories = append(categories, category)
+	}
+	token, key, err := issueAPIKey(&dbConnectionContext, query.Get("name"), permissions, categories)
+	if err != nil {
+		JSONErrorFrom(w, r, err)
+		return
+	}
+	slog.InfoContext(r.Context(), "API key issued", "apikey", key.Id, "name", key.Name, "permissions", permissions, "categories", categories)
+	res, _ := json.Marshal(struct {
+		APIKey
+		Key string `json:"key"`
+	}{key, token})
+	JSONResponseFromString(w, "{\"result\":"+string(res)+"}")
+}
+
+func ListKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := getAPIKeys(&dbConnectionContext)
+	if err != nil {
+		JSONErrorFrom(w, r, err)
+		return
+	}
+	res, _ := json.Marshal(keys)
+	JSONResponseFromString(w, "{\"result\":"+string(res)+"}")
+}
+
+func RevokeKey(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	err := revokeAPIKey(&dbConnectionContext, id)
+	if err != nil {
+		JSONErrorFrom(w, r, err)
+		return
+	}
+	slog.InfoContext(r.Context(), "API key revoked", "apikey", id)
+	JSONResponseFromString(w, "{\"result\":\"revoked\"}")
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+//																														//
+// Cell client																											//
+//																														//
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+// Every call the controller makes to a cell goes through cellCall, which
+// gives each attempt a deadline, retries the calls that are safe to repeat
+// and keeps a circuit breaker per cell so that a dead cell fails fast
+// instead of holding up every request that touches it.
+
+const (
+	cellReadTimeout   = 10 * time.Second
+	cellWriteTimeout  = 15 * time.Second
+	cellListTimeout   = 30 * time.Second
+	cellHealthTimeout = 3 * time.Second
+)
+
+const cellAttempts = 3
+const cellBackoff = 100 * time.Millisecond
+const cellMaxBackoff = 2 * time.Second
+
+// a cell is cut off after this many failures in a row, and gets one call
+// through to prove itself once the cooldown is over
+const breakerThreshold = 5
+const breakerCooldown = 30 * time.Second
+
+// the cells all sit behind the same headless service, so the per host
+// limits are what matter here
+var cellHTTPClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: 3 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+		MaxIdleConns:        256,
+		MaxIdleConnsPerHost: 32,
+		IdleConnTimeout:     90 * time.Second,
+	},
+}
+
+var errNotOnCell = errors.New("key not on cell")
+var errCircuitOpen = errors.New("circuit open")
+
+// errCellFull is a cell refusing a write it has no room for, which means
+// cellstatus thinks it has more free than it does
+var errCellFull = errors.New("cell is full")
+
+// cellStatusError is a cell answering with anything but 200
+type cellStatusError struct {
+	cellid int
+	status int
+	body   string
+}
+
+func (e *cellStatusError) Error() string {
+	return "cell " + strconv.Itoa(e.cellid) + " answered " + strconv.Itoa(e.status) + ": " + e.body
+}
+
+func (e *cellStatusError) Is(target error) bool {
+	return target == errNotOnCell && e.status == http.StatusNotFound ||
+		target == errCellFull && e.status == http.StatusInsufficientStorage
+}
+
+// isRetryableCellError tells failures of the cell or the network, which
+// may go away, from answers that will not change if we ask again
+func isRetryableCellError(err error) bool {
+	if errors.Is(err, errCellFull) {
+		return false
+	}
+	var statusErr *cellStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.status >= 500 || statusErr.status == http.StatusTooManyRequests
+	}
+	if s, ok := status.FromError(err); ok {
+		switch s.Code() {
+		case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted:
+			return true
+		}
+		return false
+	}
+	var urlErr *url.Error
+	var netErr net.Error
+	return errors.As(err, &urlErr) || errors.As(err, &netErr) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, context.DeadlineExceeded)
+}
+
+type circuitBreaker struct {
+	lock      sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+var cellBreakers = make(map[int]*circuitBreaker)
+var cellBreakersLock sync.Mutex
+
+func cellBreaker(cellid int) *circuitBreaker {
+	cellBreakersLock.Lock()
+	defer cellBreakersLock.Unlock()
+	breaker, exists := cellBreakers[cellid]
+	if !exists {
+		breaker = new(circuitBreaker)
+		cellBreakers[cellid] = breaker
+	}
+	return breaker
+}
+
+func (b *circuitBreaker) allow() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.failures < breakerThreshold {
+		return true
+	}
+	if b.probing || time.Now().Before(b.openUntil) {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+func (b *circuitBreaker) success() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.failures = 0
+	b.probing = false
+}
+
+func (b *circuitBreaker) failure(ctx context.Context, cellid int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.failures++
+	b.probing = false
+	if b.failures >= breakerThreshold {
+		if b.failures == breakerThreshold {
+			slog.WarnContext(ctx, "circuit to cell opened", "cell", cellid, "failures", b.failures)
+		}
+		b.openUntil = time.Now().Add(breakerCooldown)
+	}
+}
+
+func (b *circuitBreaker) open() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.failures >= breakerThreshold
+}
+
+// openCircuits lists the cells we are currently not talking to
+func openCircuits() []int {
+	cellBreakersLock.Lock()
+	defer cellBreakersLock.Unlock()
+	cells := []int{}
+	for cellid, breaker := range cellBreakers {
+		if breaker.open() {
+			cells = append(cells, cellid)
+		}
+	}
+	return cells
+}
+
+// cellCall runs call against a cell with a deadline of timeout for each
+// attempt. Calls that are not idempotent get a single attempt. The attempts
+// carry ctx's values, the request id among them, but not its cancellation:
+// a caller that hangs up halfway must not leave the cell and the directory
+// disagreeing.
+func cellCall(ctx context.Context, cellid int, idempotent bool, timeout time.Duration, call func(ctx context.Context) error) error {
+	breaker := cellBreaker(cellid)
+	attempts := 1
+	if idempotent {
+		attempts = cellAttempts
+	}
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			backoff := cellBackoff << uint(attempt-1)
+			if backoff > cellMaxBackoff {
+				backoff = cellMaxBackoff
+			}
+			// jitter, so the retries from a burst of requests don't land together
+			time.Sleep(backoff/2 + time.Duration(rand.Int63n(int64(backoff))))
+		}
+		if !breaker.allow() {
+			return fmt.Errorf("cell %d: %w", cellid, errCircuitOpen)
+		}
+		attemptCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), timeout)
+		err = call(attemptCtx)
+		cancel()
+		if err == nil || !isRetryableCellError(err) {
+			// an answer we don't like still means the cell is there
+			breaker.success()
+			return err
+		}
+		breaker.failure(ctx, cellid)
+		slog.WarnContext(ctx, "call to cell failed", "cell", cellid, "attempt", attempt+1, "error", err)
+	}
+	return err
+}
+
+// cellRequest sends one request to a cell and returns the body of a 200
+// answer; anything else comes back as a *cellStatusError
+func cellRequest(ctx context.Context, cellid int, method string, url string, checksum string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if checksum != "" {
+		req.Header.Set(checksumHeader, checksum)
+	}
+	if id := requestIdFrom(ctx); id != "" {
+		req.Header.Set(requestIdHeader, id)
+	}
+	injectTraceContext(ctx, req.Header)
+	resp, err := cellHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &cellStatusError{cellid, resp.StatusCode, string(body)}
+	}
+	return body, nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+//																														//
+// Cell gRPC transport																									//
+//																														//
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+// The cell functions in controller.go go through here unless CELL_TRANSPORT
+// is set to "http". The service is defined in proto/cell.proto; deadlines
+// and retries are up to the caller, see cellCall.
+
+// cellChunkSize is how much of a payload goes in each streamed message
+const cellChunkSize = 64 * 1024
+
+// one connection per cell, kept for the life of the controller; gRPC
+// reconnects on its own when a cell restarts
+var cellConns = make(map[int]*grpc.ClientConn)
+var cellConnsLock sync.Mutex
+
+func useCellGrpc() bool {
+	return cell_transport != "http"
+}
+
+func makeCellGrpcTarget(cellid int) string {
+	return cell_name_prefix + "-" + strconv.Itoa(cellid) + "." + cell_service_name + ":" + cell_grpc_port
+}
+
+func getCellClient(cellid int) (CellClient, error) {
+	cellConnsLock.Lock()
+	defer cellConnsLock.Unlock()
+	conn, exists := cellConns[cellid]
+	if !exists {
+		var err error
+		conn, err = grpc.NewClient(makeCellGrpcTarget(cellid), grpc.WithTransportCredentials(cellTransportCredentials()),
+			grpc.WithChainUnaryInterceptor(sendRequestIdUnary), grpc.WithChainStreamInterceptor(sendRequestIdStream),
+			grpc.WithStatsHandler(otelgrpc.NewClientHandler()))
+		if err != nil {
+			return nil, err
+		}
+		cellConns[cellid] = conn
+	}
+	return NewCellClient(conn), nil
+}
+
+// the request id goes to the cell in metadata, as X-Request-Id does over HTTP
+
+func outgoingRequestId(ctx context.Context) context.Context {
+	if id := requestIdFrom(ctx); id != "" {
+		return metadata.AppendToOutgoingContext(ctx, requestIdMetadata, id)
+	}
+	return ctx
+}
+
+func sendRequestIdUnary(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	return invoker(outgoingRequestId(ctx), method, req, reply, cc, opts...)
+}
+
+func sendRequestIdStream(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return streamer(outgoingRequestId(ctx), desc, cc, method, opts...)
+}
+
+func grpcCellRead(ctx context.Context, id string, cellid int) (CellValue, error) {
+	var value CellValue
+	client, err := getCellClient(cellid)
+	if err != nil {
+		return value, err
+	}
+	stream, err := client.Get(ctx, &GetRequest{Key: id})
+	if err != nil {
+		return value, err
+	}
+	var payload strings.Builder
+	for first := true; ; first = false {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if status.Code(err) == codes.NotFound {
+			return value, fmt.Errorf("cell %d does not have %s: %w", cellid, id, errNotOnCell)
+		}
+		if err != nil {
+			return value, err
+		}
+		if first {
+			value.Checksum = res.Checksum
+		}
+		payload.Write(res.Chunk)
+	}
+	value.Result = "OK"
+	value.Value = payload.String()
+	return value, nil
+}
+
+// grpcCellWrite sends the checksum with the payload, as cellWrite does, so
+// the cell can refuse anything that got mangled on the way
+func grpcCellWrite(ctx context.Context, id string, payload string, update bool, cellid int) error {
+	client, err := getCellClient(cellid)
+	if err != nil {
+		return err
+	}
+	stream, err := client.Put(ctx)
+	if err != nil {
+		return err
+	}
+	for offset := 0; offset == 0 || offset < len(payload); offset += cellChunkSize {
+		end := offset + cellChunkSize
+		if end > len(payload) {
+			end = len(payload)
+		}
+		req := &PutRequest{Chunk: []byte(payload[offset:end])}
+		if offset == 0 {
+			req.Key = id
+			req.Checksum = Checksum(payload)
+			req.Update = update
+		}
+		if err = stream.Send(req); err != nil {
+			break
+		}
+	}
+	// a failed Send only says the stream is gone, the reason comes from here
+	_, err = stream.CloseAndRecv()
+	if status.Code(err) == codes.ResourceExhausted {
+		return fmt.Errorf("cell %d has no room for %s: %w", cellid, id, errCellFull)
+	}
+	return err
+}
+
+func grpcCellDelete(ctx context.Context, id string, cellid int) error {
+	client, err := getCellClient(cellid)
+	if err != nil {
+		return err
+	}
+	_, err = client.Delete(ctx, &DeleteRequest{Key: id})
+	if status.Code(err) == codes.NotFound {
+		return fmt.Errorf("cell %d does not have %s: %w", cellid, id, errNotOnCell)
+	}
+	return err
+}
+
+// grpcCellContents lists the keys held by a cell; unlike /contents it does
+// not send the values along
+func grpcCellContents(ctx context.Context, cellid int) (*CellContents, error) {
+	client, err := getCellClient(cellid)
+	if err != nil {
+		return nil, err
+	}
+	info, err := client.Info(ctx, &InfoRequest{})
+	if err != nil {
+		return nil, err
+	}
+	stream, err := client.List(ctx, &ListRequest{})
+	if err != nil {
+		return nil, err
+	}
+	contents := new(CellContents)
+	contents.Details.FreeSpace = info.Free
+	for {
+		entry, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		contents.Details.Items = append(contents.Details.Items, IdPayloadPair{Id: entry.Key, Size: entry.Size})
+	}
+	return contents, nil
+}
+
+func grpcCellHealth(ctx context.Context, cellid int) error {
+	client, err := getCellClient(cellid)
+	if err != nil {
+		return err
+	}
+	_, err = client.Health(ctx, &HealthRequest{})
+	return err
+}
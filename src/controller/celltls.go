@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+//																														//
+// Cell TLS																												//
+//																														//
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+// With CELL_TLS_CERT and CELL_TLS_KEY set the controller talks to the cells
+// over TLS, gRPC and REST alike, and shows that certificate to them as its
+// client certificate; the cells' certificates must chain to CELL_TLS_CA and
+// name the cell's host. The files are meant to be a mounted secret: they
+// are looked at every certReloadInterval and read again when they change,
+// so rotating them needs no restart. Connections already open keep the
+// certificates they were made with.
+
+const certReloadInterval = 30 * time.Second
+
+var cellTLS *certReloader
+
+type certReloader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+
+	lock     sync.RWMutex
+	cert     *tls.Certificate
+	roots    *x509.CertPool
+	modified time.Time
+}
+
+func newCertReloader(certFile string, keyFile string, caFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	go c.watch()
+	return c, nil
+}
+
+// lastModified is when the newest of the files was written
+func (c *certReloader) lastModified() time.Time {
+	var last time.Time
+	for _, name := range []string{c.certFile, c.keyFile, c.caFile} {
+		if info, err := os.Stat(name); err == nil && info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+	}
+	return last
+}
+
+func (c *certReloader) load() error {
+	modified := c.lastModified()
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	pem, err := os.ReadFile(c.caFile)
+	if err != nil {
+		return err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem) {
+		return errors.New("no certificates in " + c.caFile)
+	}
+	c.lock.Lock()
+	c.cert, c.roots, c.modified = &cert, roots, modified
+	c.lock.Unlock()
+	return nil
+}
+
+// watch reloads the files when they change; if they cannot be read, half
+// written say, the ones loaded before stay in use
+func (c *certReloader) watch() {
+	for range time.Tick(certReloadInterval) {
+		c.lock.RLock()
+		modified := c.modified
+		c.lock.RUnlock()
+		if !c.lastModified().After(modified) {
+			continue
+		}
+		if err := c.load(); err != nil {
+			slog.Error("could not reload cell TLS certificates", "error", err)
+			continue
+		}
+		slog.Info("cell TLS certificates reloaded", "cert", c.certFile)
+	}
+}
+
+// clientConfig has the cell's certificate checked against the CA loaded
+// last by hand, rather than through RootCAs, so that a new CA is used on
+// the next handshake; the host name check is kept
+func (c *certReloader) clientConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			c.lock.RLock()
+			defer c.lock.RUnlock()
+			return c.cert, nil
+		},
+		InsecureSkipVerify: true,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return errors.New("cell showed no certificate")
+			}
+			// empty for IP addresses, which Verify would take as no check
+			if state.ServerName == "" {
+				return errors.New("no host name to check the cell's certificate against")
+			}
+			c.lock.RLock()
+			roots := c.roots
+			c.lock.RUnlock()
+			intermediates := x509.NewCertPool()
+			for _, cert := range state.PeerCertificates[1:] {
+				intermediates.AddCert(cert)
+			}
+			_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{DNSName: state.ServerName, Roots: roots,
+				Intermediates: intermediates, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}})
+			return err
+		},
+	}
+}
+
+// setupCellTLS switches both cell transports to TLS if CELL_TLS_CERT is set
+func setupCellTLS() error {
+	certFile := os.Getenv("CELL_TLS_CERT")
+	if certFile == "" {
+		slog.Warn("CELL_TLS_CERT not set, talking to the cells in plaintext")
+		return nil
+	}
+	reloader, err := newCertReloader(certFile, os.Getenv("CELL_TLS_KEY"), os.Getenv("CELL_TLS_CA"))
+	if err != nil {
+		return err
+	}
+	cellTLS = reloader
+	cellHTTPClient.Transport.(*http.Transport).TLSClientConfig = cellTLS.clientConfig()
+	slog.Info("talking to the cells over TLS", "cert", certFile)
+	return nil
+}
+
+func cellScheme() string {
+	if cellTLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+func cellTransportCredentials() credentials.TransportCredentials {
+	if cellTLS != nil {
+		return credentials.NewTLS(cellTLS.clientConfig())
+	}
+	return insecure.NewCredentials()
+}
@@ -2,21 +2,32 @@ package main
 
 import (
 	"context"
+	_ "embed"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"regexp"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
@@ -30,8 +41,25 @@ const (
 	ScalingUp   ServerStateEnum = 1
 	Draining    ServerStateEnum = 2
 	ScalingDown ServerStateEnum = 3
+	Rebalancing ServerStateEnum = 4
 )
 
+func (s ServerStateEnum) String() string {
+	switch s {
+	case SNAFU:
+		return "idle"
+	case ScalingUp:
+		return "scaling up"
+	case Draining:
+		return "draining"
+	case ScalingDown:
+		return "scaling down"
+	case Rebalancing:
+		return "rebalancing"
+	}
+	return "unknown"
+}
+
 const revision int = 117
 
 var ServerState ServerStateEnum = SNAFU
@@ -42,6 +70,8 @@ var db_port string
 var cell_port string
 var cell_name_prefix string
 var cell_service_name string
+var cell_grpc_port string
+var cell_transport string
 
 var cellCapacity int = 100
 var growThreshold float32 = 0.7
@@ -85,7 +115,7 @@ type Status struct {
 }
 
 type CellStatus struct {
-	CellId        int    `json:"_id"`
+	CellId        int    `json:"_id" bson:"_id"`
 	Capacity      int64 `json:"capacity"`
 	FreeSpace     int64 `json:"freespace"`
 	NumberOfFiles int64 `json:"numberoffile"`
@@ -96,6 +126,56 @@ type Directory struct {
 	Path     string `json:"path"`
 	Size     int64 `json:"size"`
 	CellId   int    `json:"cellid"`
+	Key      string `json:"key"`
+	Version  int64  `json:"version"`
+	Current  bool   `json:"current"`
+	Deleted  bool   `json:"deleted"`
+	Envelope *Envelope `json:"-" bson:"envelope,omitempty"`
+	ObjectMeta `bson:",inline"`
+}
+
+type ObjectMeta struct {
+	Checksum    string            `json:"checksum"`
+	ContentType string            `json:"contenttype"`
+	Metadata    map[string]string `json:"metadata"`
+	Encoding    string            `json:"encoding,omitempty" bson:",omitempty"`
+	Created     time.Time         `json:"created"`
+	Modified    time.Time         `json:"modified"`
+}
+
+type ObjectInfo struct {
+	Path       string    `json:"path"`
+	Size       int64     `json:"size"`
+	Version    int64     `json:"version"`
+	Envelope   *Envelope `json:"-" bson:"envelope,omitempty"`
+	ObjectMeta `bson:",inline"`
+}
+
+type ObjectListing struct {
+	Objects        []ObjectInfo `json:"objects"`
+	CommonPrefixes []string     `json:"commonprefixes"`
+	Truncated      bool         `json:"truncated"`
+	Continuation   string       `json:"continuation,omitempty"`
+}
+
+type Corruption struct {
+	Key      string    `json:"key"`
+	CellId   int       `json:"cellid"`
+	Repaired bool      `json:"repaired"`
+	Source   string    `json:"source"`
+	Reported time.Time `json:"reported"`
+}
+
+// MaxBytes and MaxObjects are the category's quota, 0 for none. UsedBytes
+// and Objects count every version stored, like cellstatus does.
+type Category struct {
+	Name       string    `json:"name" bson:"_id"`
+	Versioning bool      `json:"versioning"`
+	Created    time.Time `json:"created"`
+	MaxBytes   int64     `json:"maxbytes"`
+	MaxObjects int64     `json:"maxobjects"`
+	UsedBytes  int64     `json:"usedbytes"`
+	Objects    int64     `json:"objects"`
 }
 
 type DBConnectionContext struct {
@@ -103,6 +183,13 @@ type DBConnectionContext struct {
 	serverstatus *mongo.Collection
 	cellstatus   *mongo.Collection
 	directories  *mongo.Collection
+	categories   *mongo.Collection
+	corruptions  *mongo.Collection
+	apikeys      *mongo.Collection
+	transactions bool
+
+	multipartuploads *mongo.Collection
+	multipartparts   *mongo.Collection
 }
 
 var dbConnectionContext DBConnectionContext
@@ -117,11 +204,166 @@ var serverstatus Status
 //////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 
 func JSONResponseFromString(w http.ResponseWriter, res string) {
+	JSONResponseWithStatus(w, http.StatusOK, res)
+}
+
+func JSONResponseWithStatus(w http.ResponseWriter, status int, res string) {
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.WriteHeader(http.StatusOK)
+	w.WriteHeader(status)
 	io.WriteString(w, res)
 }
 
+// APIError is the body of every error response, as {"error": {...}}.
+// Clients should look at Code; Message is for people.
+type APIError struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestId string `json:"requestid"`
+}
+
+const (
+	ErrCodeBadRequest          = "bad_request"
+	ErrCodeChecksumMismatch    = "checksum_mismatch"
+	ErrCodeNotFound            = "not_found"
+	ErrCodeConflict            = "conflict"
+	ErrCodeInsufficientStorage = "insufficient_storage"
+	ErrCodeUnavailable         = "unavailable"
+	ErrCodeInternal            = "internal"
+)
+
+// requestId is the id logRequests gave the request, which is the one the
+// caller sent if it sent any, so that errors can be matched up with whatever
+// logged the request on their side
+func requestId(r *http.Request) string {
+	if id := requestIdFrom(r.Context()); id != "" {
+		return id
+	}
+	if id := r.Header.Get(requestIdHeader); id != "" {
+		return id
+	}
+	return newRequestId()
+}
+
+func JSONError(w http.ResponseWriter, r *http.Request, status int, code string, message string) {
+	id := requestId(r)
+	res, _ := json.Marshal(struct {
+		Error APIError `json:"error"`
+	}{APIError{code, message, id}})
+	w.Header().Set(requestIdHeader, id)
+	JSONResponseWithStatus(w, status, string(res))
+}
+
+// errorStatus maps the errors that come out of the object functions to a
+// status and an error code
+func errorStatus(err error) (int, string) {
+	switch {
+	case err == errBadVersion:
+		return http.StatusBadRequest, ErrCodeBadRequest
+	case err == mongo.ErrNoDocuments, errors.Is(err, errNotOnCell):
+		return http.StatusNotFound, ErrCodeNotFound
+	case err == errExists, err == errFsckRunning, err == errLastCell, err == errUpdateConflict, mongo.IsDuplicateKeyError(err):
+		return http.StatusConflict, ErrCodeConflict
+	case err == errNoSpace:
+		return http.StatusInsufficientStorage, ErrCodeInsufficientStorage
+	case errors.As(err, new(*quotaError)):
+		return http.StatusForbidden, ErrCodeQuotaExceeded
+	case errors.As(err, new(*capacityError)):
+		return http.StatusServiceUnavailable, ErrCodeUnavailable
+	case err == errScaling, err == errRepairing, errors.Is(err, errCircuitOpen), errors.Is(err, errCellFull), isRetryableCellError(err):
+		return http.StatusServiceUnavailable, ErrCodeUnavailable
+	default:
+		return http.StatusInternalServerError, ErrCodeInternal
+	}
+}
+
+func JSONErrorFrom(w http.ResponseWriter, r *http.Request, err error) {
+	status, code := errorStatus(err)
+	if retryAfter, exists := retryAfterFrom(err); exists {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(retryAfter)))
+	}
+	message := err.Error()
+	if status == http.StatusInternalServerError {
+		// don't hand out whatever mongo or a cell said, but keep it here
+		slog.ErrorContext(r.Context(), "internal error", "error", message)
+		message = "internal error"
+	}
+	JSONError(w, r, status, code, message)
+}
+
+// User metadata travels in X-Meta-* headers, both on the way in and on the
+// way out, like S3 does with x-amz-meta-*.
+const metaHeaderPrefix = "X-Meta-"
+
+func objectMetaFromRequest(r *http.Request, payload string) ObjectMeta {
+	now := time.Now().UTC()
+	meta := ObjectMeta{Checksum: Checksum(payload), ContentType: r.Header.Get("Content-Type"), Created: now, Modified: now}
+	if meta.ContentType == "" {
+		meta.ContentType = "application/octet-stream"
+	}
+	// the payload has to fit in a path segment, so clients with binary data
+	// send it encoded and tell us how
+	meta.Encoding = r.Header.Get("X-Object-Encoding")
+	for name, values := range r.Header {
+		if strings.HasPrefix(name, metaHeaderPrefix) && len(values) > 0 {
+			if meta.Metadata == nil {
+				meta.Metadata = make(map[string]string)
+			}
+			meta.Metadata[strings.ToLower(strings.TrimPrefix(name, metaHeaderPrefix))] = values[0]
+		}
+	}
+	return meta
+}
+
+// The body of a retrieve is our own JSON envelope, so the object's content
+// type goes in a header of its own rather than in Content-Type.
+func writeObjectHeaders(w http.ResponseWriter, entry Directory) {
+	if entry.Checksum != "" {
+		w.Header().Set("ETag", "\""+entry.Checksum+"\"")
+	}
+	w.Header().Set("X-Object-Content-Type", entry.ContentType)
+	if entry.Encoding != "" {
+		w.Header().Set("X-Object-Encoding", entry.Encoding)
+	}
+	w.Header().Set("X-Object-Size", strconv.FormatInt(objectSize(entry.Size, entry.Envelope), 10))
+	w.Header().Set("X-Object-Version", strconv.FormatInt(entry.Version, 10))
+	if !entry.Created.IsZero() {
+		w.Header().Set("X-Object-Created", entry.Created.Format(http.TimeFormat))
+	}
+	if !entry.Modified.IsZero() {
+		w.Header().Set("Last-Modified", entry.Modified.Format(http.TimeFormat))
+	}
+	for name, value := range entry.Metadata {
+		w.Header().Set(metaHeaderPrefix+name, value)
+	}
+}
+
+// Checksums are hex encoded SHA-256 sums of the payload. The controller
+// sends them to the cells, and clients may send one to have it checked.
+const checksumHeader = "X-Checksum-Sha256"
+
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// number of checksum mismatches seen since start, reported in /status
+var checksumMismatches int64
+
+func Checksum(payload string) string {
+	sum := sha256.Sum256([]byte(payload))
+	return hex.EncodeToString(sum[:])
+}
+
+func verifyChecksum(ctx context.Context, id string, payload string, expected string) error {
+	if expected == "" {
+		// stored before we kept checksums, nothing to compare with
+		return nil
+	}
+	if Checksum(payload) != expected {
+		atomic.AddInt64(&checksumMismatches, 1)
+		slog.WarnContext(ctx, "checksum mismatch", "key", id, "expected", expected)
+		return errChecksumMismatch
+	}
+	return nil
+}
+
 func makeCellURL(cellid int) string {
 	// FOR LOCAL TESTING
 	//
@@ -130,7 +372,7 @@ func makeCellURL(cellid int) string {
 	//} else {
 	//	return "shit"
 	//}
-	return "http://" + cell_name_prefix + "-" + strconv.Itoa(cellid) + "." + cell_service_name + ":" + cell_port
+	return cellScheme() + "://" + cell_name_prefix + "-" + strconv.Itoa(cellid) + "." + cell_service_name + ":" + cell_port
 }
 
 func makeCellHealthcheck(cellid int) string {
@@ -138,7 +380,16 @@ func makeCellHealthcheck(cellid int) string {
 }
 
 func HealthCheck(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintln(w, "{'status':'alive'}")
+	JSONResponseFromString(w, "{\"status\":\"alive\"}")
+}
+
+// openapi.json describes every route set up in main; keep the two in step
+//
+//go:embed openapi.json
+var openAPISpec string
+
+func OpenAPISpec(w http.ResponseWriter, r *http.Request) {
+	JSONResponseFromString(w, openAPISpec)
 }
 
 //////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
@@ -196,16 +447,54 @@ func pushServerStatus(conn *DBConnectionContext) error {
 	return err
 }
 
+// Two concurrent stores of the same id would otherwise both pass the
+// existence check in Store, so let the database have the final word. Every
+// version of an object has its own entry, but only one of them is current.
+func ensureDirectoryIndexes(conn *DBConnectionContext) error {
+	// entries written before versioning existed are the one and only
+	// version of their object, and live on the cell under their path
+	_, err := conn.directories.UpdateMany(context.TODO(), bson.D{{"current", bson.D{{"$exists", false}}}},
+		mongo.Pipeline{{{"$set", bson.D{
+			{"key", "$path"}, {"version", int64(0)}, {"current", true}, {"deleted", false}}}}})
+	if err != nil {
+		return err
+	}
+	conn.directories.Indexes().DropOne(context.TODO(), "category_path_unique")
+	_, err = conn.directories.Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{
+			Keys:    bson.D{{"category", 1}, {"path", 1}, {"version", 1}},
+			Options: options.Index().SetUnique(true).SetName("category_path_version_unique"),
+		},
+		{
+			Keys: bson.D{{"category", 1}, {"path", 1}},
+			Options: options.Index().SetUnique(true).SetName("category_path_current_unique").
+				SetPartialFilterExpression(bson.D{{"current", true}}),
+		},
+		{
+			Keys:    bson.D{{"key", 1}},
+			Options: options.Index().SetUnique(true).SetName("key_unique"),
+		},
+	})
+	return err
+}
+
 func getServerStatus(conn *DBConnectionContext) (Status, error) {
 	var statusInDB Status
 	err := conn.serverstatus.FindOne(context.TODO(), bson.D{{"_id", 0}}).Decode(&statusInDB)
 	return statusInDB, err
 }
 
-func getDirectoryEntryCellId(conn *DBConnectionContext, category string, fullpath string) (int, error) {
+func getDirectoryEntryCellId(ctx context.Context, conn *DBConnectionContext, category string, fullpath string) (int, error) {
+	ctx, span := tracer.Start(ctx, "getDirectoryEntryCellId")
 	var directoryEntry Directory
-	err := conn.directories.FindOne(context.TODO(), bson.D{
-		{"category", category}, {"path", fullpath}}).Decode(&directoryEntry)
+	err := conn.directories.FindOne(ctx, bson.D{
+		{"category", category}, {"path", fullpath}, {"current", true}, {"deleted", false}}).Decode(&directoryEntry)
+	if err == mongo.ErrNoDocuments {
+		// not finding it is an answer, not a failure
+		span.End()
+	} else {
+		endSpan(span, err)
+	}
 	if err != nil {
 		return -1, err
 	} else {
@@ -213,236 +502,1074 @@ func getDirectoryEntryCellId(conn *DBConnectionContext, category string, fullpat
 	}
 }
 
-func addDirectoryEntry(conn *DBConnectionContext, category string, fullpath string, size int64, cellid int) error {
-	_, err := conn.directories.InsertOne(context.TODO(), bson.D{
-		{"category", category}, {"path", fullpath}, {"size", size}, {"cellid", cellid}})
-	return err
+// getDirectoryEntry returns the current version of an object, which may be
+// a tombstone if the object was deleted from a versioned category
+func getDirectoryEntry(conn *DBConnectionContext, category string, fullpath string) (Directory, error) {
+	var directoryEntry Directory
+	err := conn.directories.FindOne(context.TODO(), bson.D{
+		{"category", category}, {"path", fullpath}, {"current", true}}).Decode(&directoryEntry)
+	return directoryEntry, err
+}
+
+func getDirectoryEntryByKey(conn *DBConnectionContext, key string) (Directory, error) {
+	var directoryEntry Directory
+	err := conn.directories.FindOne(context.TODO(), bson.D{{"key", key}}).Decode(&directoryEntry)
+	return directoryEntry, err
 }
 
-func removeDirectoryEntry(conn *DBConnectionContext, category string, fullpath string) (int64, error) {
+func getDirectoryVersion(conn *DBConnectionContext, category string, fullpath string, version int64) (Directory, error) {
 	var directoryEntry Directory
 	err := conn.directories.FindOne(context.TODO(), bson.D{
-		{"category", category}, {"path", fullpath}}).Decode(&directoryEntry)
+		{"category", category}, {"path", fullpath}, {"version", version}}).Decode(&directoryEntry)
+	return directoryEntry, err
+}
+
+func getDirectoryVersions(conn *DBConnectionContext, category string, fullpath string) ([]Directory, error) {
+	var entries []Directory
+	cursor, err := conn.directories.Find(context.TODO(), bson.D{
+		{"category", category}, {"path", fullpath}}, options.Find().SetSort(bson.D{{"version", -1}}))
 	if err != nil {
-		return 0, err
-	} else {
-		fmt.Println(" >> removeDirectoryEntry attempting to return " + strconv.Itoa(int(directoryEntry.Size)))
-		_, err = conn.directories.DeleteOne(context.TODO(), bson.D{
-			{"category", category}, {"path", fullpath}})
-		return directoryEntry.Size, err
+		return nil, err
 	}
+	defer cursor.Close(context.TODO())
+	err = cursor.All(context.TODO(), &entries)
+	return entries, err
+}
+
+func addDirectoryEntry(ctx context.Context, conn *DBConnectionContext, entry Directory) error {
+	_, err := conn.directories.InsertOne(ctx, entry)
+	return err
+}
+
+func removeDirectoryEntry(ctx context.Context, conn *DBConnectionContext, category string, fullpath string) (Directory, error) {
+	var directoryEntry Directory
+	err := conn.directories.FindOneAndDelete(ctx, bson.D{
+		{"category", category}, {"path", fullpath}, {"current", true}, {"deleted", false}}).Decode(&directoryEntry)
+	return directoryEntry, err
 }
 
-func updateDirectoryEntry(conn *DBConnectionContext, category string, fullpath string, oldcellid int, newcellid int) error {
-	_, err := conn.directories.UpdateOne(context.TODO(), bson.D{{"category", category}, {"path", fullpath}},
+func removeDirectoryVersion(ctx context.Context, conn *DBConnectionContext, category string, fullpath string, version int64) (Directory, error) {
+	var directoryEntry Directory
+	err := conn.directories.FindOneAndDelete(ctx, bson.D{
+		{"category", category}, {"path", fullpath}, {"version", version}, {"current", false}}).Decode(&directoryEntry)
+	return directoryEntry, err
+}
+
+func setDirectoryEntryCurrent(ctx context.Context, conn *DBConnectionContext, category string, fullpath string, version int64, current bool) error {
+	res, err := conn.directories.UpdateOne(ctx, bson.D{{"category", category}, {"path", fullpath}, {"version", version}},
 		bson.D{
 			{"$set", bson.D{
-				{"cellid", newcellid},
+				{"current", current},
 			},
 			},
 		})
+	if err == nil && res.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
 	return err
 }
 
-func findCellWithFreeSpace(conn *DBConnectionContext, requestedSpace int64) int {
+// updateDirectoryEntry points whatever entry lives on the cell under key at
+// a different cell; cells only know about keys, not categories or versions
+func updateDirectoryEntry(ctx context.Context, conn *DBConnectionContext, key string, oldcellid int, newcellid int) error {
+	res, err := conn.directories.UpdateOne(ctx, bson.D{{"key", key}, {"cellid", oldcellid}},
+		bson.D{
+			{"$set", bson.D{
+				{"cellid", newcellid},
+			},
+			},
+		})
+	if err == nil && res.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return err
+}
 
-	var results []*CellStatus
+// errUpdateConflict is an update losing the race with another write of the
+// same object, which would otherwise both account from the same old size
+var errUpdateConflict = errors.New("the object was changed while being updated, try again")
 
-	cursor, err := conn.cellstatus.Find(context.TODO(), bson.D{{}})
+// replaceDirectoryEntry only replaces old as it was read: stored times are
+// kept to the millisecond, so old.Modified is too
+func replaceDirectoryEntry(ctx context.Context, conn *DBConnectionContext, old Directory, updated Directory) error {
+	res, err := conn.directories.UpdateOne(ctx, bson.D{{"category", old.Category}, {"path", old.Path}, {"current", true}, {"cellid", old.CellId},
+		{"size", old.Size}, {"modified", old.Modified.Truncate(time.Millisecond)}},
+		bson.D{
+			{"$set", bson.D{
+				{"cellid", updated.CellId},
+				{"size", updated.Size},
+				{"checksum", updated.Checksum},
+				{"contenttype", updated.ContentType},
+				{"metadata", updated.Metadata},
+				{"encoding", updated.Encoding},
+				{"modified", updated.Modified},
+				{"envelope", updated.Envelope},
+			},
+			},
+		})
+	if err == nil && res.MatchedCount == 0 {
+		return errUpdateConflict
+	}
+	return err
+}
 
+// listObjects walks the current versions under prefix in path order,
+// starting after the given path, a page at a time
+func listObjects(conn *DBConnectionContext, category string, prefix string, delimiter string, after string, limit int) (ObjectListing, error) {
+	filter := bson.D{{"category", category}, {"current", true}, {"deleted", false},
+		{"path", bson.D{{"$regex", "^" + regexp.QuoteMeta(prefix)}, {"$gt", after}}}}
+	cursor, err := conn.directories.Find(context.TODO(), filter, options.Find().
+		SetSort(bson.D{{"path", 1}}).
+		SetProjection(bson.D{{"cellid", 0}, {"key", 0}}))
 	if err != nil {
-		fmt.Println("Error retrieving cellstatuses from DB")
-		return -1
-	} else {
+		return ObjectListing{}, err
+	}
+	defer cursor.Close(context.TODO())
 
-		for cursor.Next(context.TODO()) {
-			var elem CellStatus
-			err := cursor.Decode(&elem)
-			if err != nil {
-				fmt.Println("Error decoding cellstatus from db")
-				//return -1
-			} else {
-				results = append(results, &elem)
-			}
+	page := newListingPage(prefix, delimiter, after, limit)
+	for cursor.Next(context.TODO()) {
+		var object ObjectInfo
+		if err := cursor.Decode(&object); err != nil {
+			return page.listing, err
+		}
+		object.Size = objectSize(object.Size, object.Envelope)
+		if !page.add(object) {
+			break
 		}
+	}
+	return page.listing, cursor.Err()
+}
 
-		fmt.Println(strconv.Itoa(len(results)) + " found in db")
-		cursor.Close(context.TODO())
+// listingPage puts a page of a listing together from the objects after the
+// continuation, in path order. With a delimiter, paths that have it past
+// the prefix are rolled up into common prefixes, S3 style, and each of those
+// counts as one entry towards the limit.
+type listingPage struct {
+	listing   ObjectListing
+	prefix    string
+	delimiter string
+	after     string
+	limit     int
+	last      string
+	count     int
+}
 
-		for cellid, element := range results {
-			if element.FreeSpace >= requestedSpace {
-				if (cellid == serverstatus.NumberOfCells-1) && (ServerState == Draining) {
-					CancelDrain()
-				}
-				return cellid
-			}
+func newListingPage(prefix string, delimiter string, after string, limit int) *listingPage {
+	return &listingPage{listing: ObjectListing{Objects: []ObjectInfo{}, CommonPrefixes: []string{}},
+		prefix: prefix, delimiter: delimiter, after: after, limit: limit}
+}
+
+// add takes the next object, and says whether the page has room for more
+func (p *listingPage) add(object ObjectInfo) bool {
+	commonPrefix := ""
+	if p.delimiter != "" {
+		if i := strings.Index(object.Path[len(p.prefix):], p.delimiter); i != -1 {
+			commonPrefix = object.Path[:len(p.prefix)+i+len(p.delimiter)]
 		}
+	}
+	if commonPrefix != "" && commonPrefix == p.last {
+		// still inside the prefix we already rolled up
+		return true
+	}
+	// resuming right after a common prefix means skipping what is under it
+	if commonPrefix != "" && commonPrefix == p.after {
+		return true
+	}
+	if p.count == p.limit {
+		p.listing.Truncated = true
+		p.listing.Continuation = base64.RawURLEncoding.EncodeToString([]byte(p.last))
+		return false
+	}
+	if commonPrefix != "" {
+		p.listing.CommonPrefixes = append(p.listing.CommonPrefixes, commonPrefix)
+		p.last = commonPrefix
+	} else {
+		p.listing.Objects = append(p.listing.Objects, object)
+		p.last = object.Path
+	}
+	p.count++
+	return true
+}
 
-		return -1
+func addCorruption(conn *DBConnectionContext, corruption Corruption) error {
+	_, err := conn.corruptions.InsertOne(context.TODO(), corruption)
+	return err
+}
+
+func getCorruptions(conn *DBConnectionContext) ([]Corruption, error) {
+	var corruptions []Corruption
+	cursor, err := conn.corruptions.Find(context.TODO(), bson.D{{}}, options.Find().SetSort(bson.D{{"reported", -1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+	err = cursor.All(context.TODO(), &corruptions)
+	return corruptions, err
+}
 
+func getCategory(conn *DBConnectionContext, name string) (Category, error) {
+	category := Category{Name: name}
+	err := conn.categories.FindOne(context.TODO(), bson.D{{"_id", name}}).Decode(&category)
+	if err == mongo.ErrNoDocuments {
+		return category, nil
 	}
+	return category, err
 }
 
-func removeUsedStorage(conn *DBConnectionContext, amount int64, cellid int) {
-	_, err := conn.serverstatus.UpdateOne(context.TODO(), bson.D{{"_id", 0}}, bson.D{{"$inc", bson.D{{"usedspace", -int64(amount)}}}})
+func getCategories(conn *DBConnectionContext) ([]Category, error) {
+	var categories []Category
+	cur, err := conn.categories.Find(context.TODO(), bson.D{}, options.Find().SetSort(bson.D{{"_id", 1}}))
 	if err != nil {
-		fmt.Println(err)
+		return nil, err
+	}
+	err = cur.All(context.TODO(), &categories)
+	return categories, err
+}
+
+func createCategory(conn *DBConnectionContext, name string) error {
+	_, err := conn.categories.InsertOne(context.TODO(), Category{Name: name, Created: time.Now().UTC()})
+	return err
+}
+
+func setCategoryVersioning(conn *DBConnectionContext, name string, versioning bool) error {
+	_, err := conn.categories.UpdateOne(context.TODO(), bson.D{{"_id", name}},
+		bson.D{{"$set", bson.D{{"versioning", versioning}}}}, options.Update().SetUpsert(true))
+	return err
+}
+
+func setCategoryQuota(conn *DBConnectionContext, name string, maxBytes int64, maxObjects int64) error {
+	_, err := conn.categories.UpdateOne(context.TODO(), bson.D{{"_id", name}},
+		bson.D{{"$set", bson.D{{"maxbytes", maxBytes}, {"maxobjects", maxObjects}}}}, options.Update().SetUpsert(true))
+	return err
+}
+
+// Room on a cell is reserved before anything is written to it, by taking
+// it off freespace in cellstatus with an $inc that only matches while the
+// cell still has that much free. Stores running at the same time can then
+// never all pick the same nearly full cell. The commit accounts for the object as always, after which the
+// reservation is given back; until then the room counts twice, which only
+// errs on the safe side. What is held is also counted in reserved, so that
+// fsck can recompute freespace without losing the reservations of stores
+// in flight. Room held by a controller that died in between is given back
+// by clearReservations when the next one starts, which the controller lease
+// makes the only one running.
+
+// reserveFreeSpace takes requestedSpace off the first cell with that much
+// free, and returns the cell, or -1 if none has room
+func reserveFreeSpace(ctx context.Context, conn *DBConnectionContext, requestedSpace int64) int {
+
+	ctx, span := tracer.Start(ctx, "reserveFreeSpace", trace.WithAttributes(attribute.Int64("eks.requested_bytes", requestedSpace)))
+
+	var status CellStatus
+	err := conn.cellstatus.FindOneAndUpdate(ctx, bson.D{{"freespace", bson.D{{"$gte", requestedSpace}}}},
+		bson.D{{"$inc", bson.D{{"freespace", -requestedSpace}, {"reserved", requestedSpace}}}},
+		options.FindOneAndUpdate().SetSort(bson.D{{"_id", 1}})).Decode(&status)
+	if err == mongo.ErrNoDocuments {
+		span.SetAttributes(cellAttribute(-1))
+		span.End()
+		return -1
+	} else if err != nil {
+		slog.ErrorContext(ctx, "could not reserve space", "error", err)
+		endSpan(span, err)
+		return -1
+	}
+
+	if (status.CellId == serverstatus.NumberOfCells-1) && (ServerState == Draining) {
+		CancelDrain()
 	}
-	_, err = conn.cellstatus.UpdateOne(context.TODO(), bson.D{{"_id", cellid}}, bson.D{{"$inc", bson.D{{"freespace", int64(amount)}}}})
+	span.SetAttributes(cellAttribute(status.CellId))
+	span.End()
+	return status.CellId
+}
+
+// reserveFreeSpaceOn takes requestedSpace off the given cell, if it has it
+func reserveFreeSpaceOn(ctx context.Context, conn *DBConnectionContext, cellid int, requestedSpace int64) (bool, error) {
+	res, err := conn.cellstatus.UpdateOne(ctx, bson.D{{"_id", cellid}, {"freespace", bson.D{{"$gte", requestedSpace}}}},
+		bson.D{{"$inc", bson.D{{"freespace", -requestedSpace}, {"reserved", requestedSpace}}}})
 	if err != nil {
-		fmt.Println(err)
+		return false, err
 	}
-	_, err = conn.cellstatus.UpdateOne(context.TODO(), bson.D{{"_id", cellid}}, bson.D{{"$inc", bson.D{{"numberoffiles", -1}}}})
+	return res.MatchedCount == 1, nil
+}
+
+func releaseFreeSpace(ctx context.Context, conn *DBConnectionContext, cellid int, reservedSpace int64) error {
+	_, err := conn.cellstatus.UpdateOne(ctx, bson.D{{"_id", cellid}}, bson.D{{"$inc", bson.D{
+		{"freespace", reservedSpace}, {"reserved", -reservedSpace}}}})
+	return err
+}
+
+// clearReservations gives back the room and quota still reserved when the
+// controller starts, which nothing will release any more: it holds the
+// controller lease, so no other controller is running, and it has no stores
+// in flight yet
+func clearReservations(conn *DBConnectionContext) error {
+	_, err := conn.cellstatus.UpdateMany(context.TODO(), bson.D{{"reserved", bson.D{{"$ne", 0}}}},
+		mongo.Pipeline{{{"$set", bson.D{
+			{"freespace", bson.D{{"$add", bson.A{"$freespace", bson.D{{"$ifNull", bson.A{"$reserved", 0}}}}}}},
+			{"reserved", 0}}}}})
 	if err != nil {
-		fmt.Println(err)
+		return err
 	}
-	serverstatus.UsedSpace -= amount
+	_, err = conn.categories.UpdateMany(context.TODO(), bson.D{{"$or", bson.A{
+		bson.D{{"reservedbytes", bson.D{{"$ne", 0}}}}, bson.D{{"reservedobjects", bson.D{{"$ne", 0}}}}}}},
+		mongo.Pipeline{{{"$set", bson.D{
+			{"usedbytes", bson.D{{"$subtract", bson.A{"$usedbytes", bson.D{{"$ifNull", bson.A{"$reservedbytes", 0}}}}}}},
+			{"objects", bson.D{{"$subtract", bson.A{"$objects", bson.D{{"$ifNull", bson.A{"$reservedobjects", 0}}}}}}},
+			{"reservedbytes", 0}, {"reservedobjects", 0}}}}})
+	return err
 }
 
-func addUsedStorage(conn *DBConnectionContext, amount int64, cellid int) {
-	_, err := conn.serverstatus.UpdateOne(context.TODO(), bson.D{{"_id", 0}}, bson.D{{"$inc", bson.D{{"usedspace", amount}}}})
+func removeUsedStorage(ctx context.Context, conn *DBConnectionContext, amount int64, cellid int) error {
+	_, err := conn.serverstatus.UpdateOne(ctx, bson.D{{"_id", 0}}, bson.D{{"$inc", bson.D{{"usedspace", -amount}}}})
 	if err != nil {
-		fmt.Println(err)
+		return err
 	}
-	_, err = conn.cellstatus.UpdateOne(context.TODO(), bson.D{{"_id", cellid}}, bson.D{{"$inc", bson.D{{"freespace", -int64(amount)}}}})
+	_, err = conn.cellstatus.UpdateOne(ctx, bson.D{{"_id", cellid}}, bson.D{{"$inc", bson.D{
+		{"freespace", amount}, {"numberoffiles", -1}}}})
+	return err
+}
+
+func addUsedStorage(ctx context.Context, conn *DBConnectionContext, amount int64, cellid int) (err error) {
+	ctx, span := tracer.Start(ctx, "addUsedStorage", trace.WithAttributes(attribute.Int64("eks.bytes", amount), cellAttribute(cellid)))
+	defer func() { endSpan(span, err) }()
+	_, err = conn.serverstatus.UpdateOne(ctx, bson.D{{"_id", 0}}, bson.D{{"$inc", bson.D{{"usedspace", amount}}}})
 	if err != nil {
-		fmt.Println(err)
+		return err
 	}
-	_, err = conn.cellstatus.UpdateOne(context.TODO(), bson.D{{"_id", cellid}}, bson.D{{"$inc", bson.D{{"numberoffiles", 1}}}})
+	_, err = conn.cellstatus.UpdateOne(ctx, bson.D{{"_id", cellid}}, bson.D{{"$inc", bson.D{
+		{"freespace", -amount}, {"numberoffiles", 1}}}})
+	return err
+}
+
+func moveUsedStorage(ctx context.Context, conn *DBConnectionContext, amount int64, fromcell int, tocell int) error {
+	err := removeUsedStorage(ctx, conn, amount, fromcell)
 	if err != nil {
-		fmt.Println(err)
+		return err
 	}
-	serverstatus.UsedSpace += amount
+	return addUsedStorage(ctx, conn, amount, tocell)
+}
+
+// addCategoryUsage keeps the counts the category's quota is checked
+// against. A category nobody has configured gets its document here.
+func addCategoryUsage(ctx context.Context, conn *DBConnectionContext, category string, amount int64, objects int64) error {
+	_, err := conn.categories.UpdateOne(ctx, bson.D{{"_id", category}},
+		bson.D{{"$inc", bson.D{{"usedbytes", amount}, {"objects", objects}}},
+			{"$setOnInsert", bson.D{{"created", time.Now().UTC()}}}},
+		options.Update().SetUpsert(true))
+	return err
 }
 
 //////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 //																														//
-// Cell functions																										//
+// Transaction functions																								//
 //																														//
 //////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 
-func InitializeNewCell() int64 {
-	return int64(cellCapacity)
+// Multi-document transactions need a replica set (or mongos). Against a
+// standalone mongod we fall back to running the same steps one after the
+// other, which is what we always did before.
+func detectTransactionSupport(conn *DBConnectionContext) bool {
+	var hello bson.M
+	err := conn.client.Database("admin").RunCommand(context.TODO(), bson.D{{"isMaster", 1}}).Decode(&hello)
+	if err != nil {
+		return false
+	}
+	if _, isReplicaSet := hello["setName"]; isReplicaSet {
+		return true
+	}
+	return hello["msg"] == "isdbgrid"
 }
 
-func CellDelete(category string, id string, cellid int) error {
-	cellURL := makeCellURL(cellid)
-	client := &http.Client{}
-	req, err := http.NewRequest("DELETE", cellURL+"/"+id+"/_", nil)
-	if err != nil {
-		return err
+// The steps get ctx for its trace and request id, but not its
+// cancellation: a client hanging up should not leave half the steps done.
+func runTransaction(ctx context.Context, conn *DBConnectionContext, steps func(ctx context.Context) error) error {
+	ctx = context.WithoutCancel(ctx)
+	if !conn.transactions {
+		return steps(ctx)
 	}
-	resp, err := client.Do(req)
+	session, err := conn.client.StartSession()
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
-	return nil
+	defer session.EndSession(ctx)
+	_, err = session.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+		return nil, steps(sessCtx)
+	})
+	return err
 }
 
-func GetCellContents(cellid int) (*CellContents, error) {
-	contents := new(CellContents)
-	cellURL := makeCellURL(cellid)
-	result, err := http.Get(cellURL + "/contents")
-	fmt.Println("  >> GetCellContents: Calling " + cellURL)
-	if err != nil {
-		fmt.Println("  >> GetCellContents: 1) error")
-		return nil, err
-	} else {
-		fmt.Println("  >> GetCellContents: http read ok")
-		defer result.Body.Close()
-		body, _ := ioutil.ReadAll(result.Body)
-		err = json.Unmarshal(body, &contents)
+// The in-memory serverstatus is only touched once the transaction has
+// committed, because WithTransaction may run the steps more than once.
+
+func commitStore(ctx context.Context, conn *DBConnectionContext, entry Directory) error {
+	err := runTransaction(ctx, conn, func(ctx context.Context) error {
+		err := addDirectoryEntry(ctx, conn, entry)
 		if err != nil {
-			fmt.Println("  >> GetCellContents: error unmarshalling result")
-			return nil, err
-		} else {
-			fmt.Println("  >> GetCellContents: Contents OK")
-			return contents, nil
+			return err
 		}
+		err = addCategoryUsage(ctx, conn, entry.Category, entry.Size, 1)
+		if err != nil {
+			return err
+		}
+		return addUsedStorage(ctx, conn, entry.Size, entry.CellId)
+	})
+	if err == nil {
+		serverstatus.UsedSpace += entry.Size
 	}
+	return err
 }
 
-func CellGet(category string, id string, cellid int) (string, error) {
-	cellURL := makeCellURL(cellid)
-	result, err := http.Get(cellURL + "/" + id + "/_")
-	if err != nil {
-		return "", err
-	} else {
-		defer result.Body.Close()
-		body, _ := ioutil.ReadAll(result.Body) // change this for large files
-		//fmt.Println("get:\n", keepLines(string(body), 3))
-		//JSONResponseFromString(w, "{\"result\":"+string(body)+"}")
-		return string(body), nil
+func commitDelete(ctx context.Context, conn *DBConnectionContext, category string, fullpath string) (Directory, error) {
+	var removed Directory
+	err := runTransaction(ctx, conn, func(ctx context.Context) error {
+		entry, err := removeDirectoryEntry(ctx, conn, category, fullpath)
+		if err != nil {
+			return err
+		}
+		removed = entry
+		err = addCategoryUsage(ctx, conn, entry.Category, -entry.Size, -1)
+		if err != nil {
+			return err
+		}
+		return removeUsedStorage(ctx, conn, entry.Size, entry.CellId)
+	})
+	if err == nil {
+		serverstatus.UsedSpace -= removed.Size
 	}
+	return removed, err
 }
 
-func CellPost(category string, id string, payload string, cellid int) error {
-	cellURL := makeCellURL(cellid)
-	_, err := http.Post(cellURL+"/"+id+"/"+payload, "application/text", nil)
-	return err
+// skipMove undoes the copy made to tocell of a key the directory did not
+// have on the cell being emptied: one deleted or moved since the cell was
+// listed, or an orphan. Its reservation is gone, so the copy must be too.
+func skipMove(ctx context.Context, conn *DBConnectionContext, key string, tocell int) {
+	slog.InfoContext(ctx, "skipped, no longer in the directory on this cell", "key", key)
+	skipOperationKey()
+	if entry, err := getDirectoryEntryByKey(conn, key); err == nil && entry.CellId == tocell {
+		// the object went there on its own since, so the copy is the object
+		return
+	}
+	if err := CellDelete(ctx, "default", key, tocell); err != nil {
+		slog.WarnContext(ctx, "could not remove copy of skipped object", "key", key, "cell", tocell, "error", err)
+	}
 }
 
-func CopyCell(category string, id string, fromcell int, tocell int) error {
-	fromURL := makeCellURL(fromcell)
-	toURL := makeCellURL(tocell)
-	read, errRead := http.Get(fromURL + "/" + id + "/_")
-	if errRead != nil {
-		return errRead
-	} else {
-		defer read.Body.Close()
-		body, _ := ioutil.ReadAll(read.Body)
-		payload := string(body)
-		_, errWrite := http.Post(toURL+"/"+id+"/"+payload, "application/text", nil)
-		if errWrite != nil {
-			return errWrite
-		} else {
-			return nil
+func commitMove(ctx context.Context, conn *DBConnectionContext, key string, size int64, fromcell int, tocell int) error {
+	return runTransaction(ctx, conn, func(ctx context.Context) error {
+		err := updateDirectoryEntry(ctx, conn, key, fromcell, tocell)
+		if err != nil {
+			return err
 		}
-	}
+		return moveUsedStorage(ctx, conn, size, fromcell, tocell)
+	})
 }
 
-func detectLivingCells() int {
-	var err error
-	var id int
-	id = 0
-	err = nil
-	for err == nil {
-		url := makeCellHealthcheck(id)
-		fmt.Println("URL: " + url)
-		_, err = http.Get(url)
-		if err == nil {
-			fmt.Println("  >> the error was nil")
-		} else {
-			fmt.Println("  >> the error was: ")
-			fmt.Println(err)
+func commitUpdate(ctx context.Context, conn *DBConnectionContext, old Directory, updated Directory) error {
+	err := runTransaction(ctx, conn, func(ctx context.Context) error {
+		err := replaceDirectoryEntry(ctx, conn, old, updated)
+		if err != nil {
+			return err
+		}
+		err = addCategoryUsage(ctx, conn, updated.Category, updated.Size-old.Size, 0)
+		if err != nil {
+			return err
 		}
-		id = id + 1
+		err = removeUsedStorage(ctx, conn, old.Size, old.CellId)
+		if err != nil {
+			return err
+		}
+		return addUsedStorage(ctx, conn, updated.Size, updated.CellId)
+	})
+	if err == nil {
+		serverstatus.UsedSpace += updated.Size - old.Size
 	}
-	return id - 1
+	return err
 }
 
-//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
-//																														//
-// Kubernetes functions																									//
-//																														//
-//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
-
-func ScaleStatefulSet(toSize int) error {
-	//fmt.Println("  >> scaling stateful set to size " + strconv.Itoa(toSize))
-	sts, err := clientset.AppsV1().StatefulSets("default").Get(StatefulSetName, metav1.GetOptions{})
-	if err == nil {
-		*sts.Spec.Replicas = int32(toSize)
-		_, err := clientset.AppsV1().StatefulSets("default").Update(sts)
+// commitVersion makes entry the current version of its object, retiring
+// previous (if any). Tombstones take no space on any cell.
+func commitVersion(ctx context.Context, conn *DBConnectionContext, previous *Directory, entry Directory) error {
+	err := runTransaction(ctx, conn, func(ctx context.Context) error {
+		if previous != nil {
+			err := setDirectoryEntryCurrent(ctx, conn, previous.Category, previous.Path, previous.Version, false)
+			if err != nil {
+				return err
+			}
+		}
+		err := addDirectoryEntry(ctx, conn, entry)
+		if err != nil || entry.Deleted {
+			return err
+		}
+		err = addCategoryUsage(ctx, conn, entry.Category, entry.Size, 1)
 		if err != nil {
 			return err
-		} else {
-			return nil
 		}
-	} else {
-		return err
+		return addUsedStorage(ctx, conn, entry.Size, entry.CellId)
+	})
+	if err == nil && !entry.Deleted {
+		serverstatus.UsedSpace += entry.Size
 	}
-	//return nil
+	return err
+}
+
+func rollbackVersion(ctx context.Context, conn *DBConnectionContext, previous *Directory, entry Directory) error {
+	err := runTransaction(ctx, conn, func(ctx context.Context) error {
+		_, err := conn.directories.DeleteOne(ctx, bson.D{
+			{"category", entry.Category}, {"path", entry.Path}, {"version", entry.Version}})
+		if err != nil {
+			return err
+		}
+		if previous != nil {
+			err = setDirectoryEntryCurrent(ctx, conn, previous.Category, previous.Path, previous.Version, true)
+			if err != nil {
+				return err
+			}
+		}
+		if entry.Deleted {
+			return nil
+		}
+		err = addCategoryUsage(ctx, conn, entry.Category, -entry.Size, -1)
+		if err != nil {
+			return err
+		}
+		return removeUsedStorage(ctx, conn, entry.Size, entry.CellId)
+	})
+	if err == nil && !entry.Deleted {
+		serverstatus.UsedSpace -= entry.Size
+	}
+	return err
+}
+
+func commitPurge(ctx context.Context, conn *DBConnectionContext, category string, fullpath string, version int64) (Directory, error) {
+	var removed Directory
+	err := runTransaction(ctx, conn, func(ctx context.Context) error {
+		entry, err := removeDirectoryVersion(ctx, conn, category, fullpath, version)
+		if err != nil {
+			return err
+		}
+		removed = entry
+		if entry.Deleted {
+			return nil
+		}
+		err = addCategoryUsage(ctx, conn, entry.Category, -entry.Size, -1)
+		if err != nil {
+			return err
+		}
+		return removeUsedStorage(ctx, conn, entry.Size, entry.CellId)
+	})
+	if err == nil && !removed.Deleted {
+		serverstatus.UsedSpace -= removed.Size
+	}
+	return removed, err
+}
+
+var errNoSpace = errors.New("no cell has enough free space")
+
+var errExists = errors.New("item exists")
+
+// createObject stores an object that does not exist yet
+func createObject(ctx context.Context, conn *DBConnectionContext, category string, fullpath string, payload string, meta ObjectMeta) (Directory, error) {
+	leave, err := enterWrite()
+	if err != nil {
+		return Directory{}, err
+	}
+	defer leave()
+	key := versionKey(category, fullpath, 0)
+	stored, envelope, err := sealPayload(key, payload)
+	if err != nil {
+		return Directory{}, err
+	}
+	size := int64(len(stored))
+	releaseQuota, err := reserveQuota(ctx, conn, category, size, 1)
+	if err != nil {
+		return Directory{}, err
+	}
+	defer releaseQuota()
+	cellid, release, err := admitStore(ctx, conn, size, "create")
+	if err != nil {
+		return Directory{}, err
+	}
+	slog.DebugContext(ctx, "storing object", "path", fullpath, "cell", cellid)
+	entry := Directory{Category: category, Path: fullpath, Size: size, CellId: cellid,
+		Key: key, Current: true, Envelope: envelope, ObjectMeta: meta}
+	err = commitStore(ctx, conn, entry)
+	// cellstatus and the category have it now, or never will
+	release()
+	releaseQuota()
+	if mongo.IsDuplicateKeyError(err) {
+		return Directory{}, errExists
+	} else if err != nil {
+		return Directory{}, err
+	}
+	err = CellPost(ctx, category, entry.Key, stored, cellid)
+	if err != nil {
+		// the cell never got the data, so take back the directory entry and the accounting
+		_, undoErr := commitDelete(ctx, conn, category, fullpath)
+		if undoErr != nil {
+			slog.ErrorContext(ctx, "could not undo store", "path", fullpath, "error", undoErr)
+		}
+		return Directory{}, err
+	}
+	return entry, nil
+}
+
+// updateObject replaces the value and metadata of an existing object. It
+// stays on its cell when the size delta fits there, otherwise it is written
+// to another cell with room for it and removed from the old one.
+func updateObject(ctx context.Context, conn *DBConnectionContext, category string, fullpath string, payload string, meta ObjectMeta) (Directory, error) {
+	leave, err := enterWrite()
+	if err != nil {
+		return Directory{}, err
+	}
+	defer leave()
+	entry, err := getDirectoryEntry(conn, category, fullpath)
+	if err != nil {
+		return Directory{}, err
+	}
+	if entry.Deleted {
+		return Directory{}, mongo.ErrNoDocuments
+	}
+	stored, envelope, err := sealPayload(entry.Key, payload)
+	if err != nil {
+		return Directory{}, err
+	}
+	size := int64(len(stored))
+	releaseQuota, err := reserveQuota(ctx, conn, category, size-entry.Size, 0)
+	if err != nil {
+		return Directory{}, err
+	}
+	defer releaseQuota()
+	fits, release, err := reserveSpaceOn(ctx, conn, entry.CellId, size-entry.Size)
+	if err != nil {
+		return Directory{}, err
+	}
+	cellid := entry.CellId
+	if !fits {
+		cellid, release, err = admitStore(ctx, conn, size, "update")
+		if err != nil {
+			return Directory{}, err
+		}
+		slog.InfoContext(ctx, "relocating object", "path", fullpath, "from", entry.CellId, "to", cellid)
+	}
+	updated := entry
+	updated.Size = size
+	updated.CellId = cellid
+	updated.Checksum = meta.Checksum
+	updated.ContentType = meta.ContentType
+	updated.Metadata = meta.Metadata
+	updated.Encoding = meta.Encoding
+	updated.Modified = meta.Modified
+	updated.Envelope = envelope
+	err = commitUpdate(ctx, conn, entry, updated)
+	release()
+	releaseQuota()
+	if err != nil {
+		return Directory{}, err
+	}
+	if cellid == entry.CellId {
+		err = CellPut(ctx, category, entry.Key, stored, cellid)
+	} else {
+		err = CellPost(ctx, category, entry.Key, stored, cellid)
+	}
+	if err != nil {
+		// the old value is still where it was, point the directory back at it
+		undoErr := commitUpdate(ctx, conn, updated, entry)
+		if undoErr != nil {
+			slog.ErrorContext(ctx, "could not undo update", "path", fullpath, "error", undoErr)
+		}
+		return Directory{}, err
+	}
+	if cellid != entry.CellId {
+		deleteErr := CellDelete(ctx, category, entry.Key, entry.CellId)
+		if deleteErr != nil {
+			// fsck will find the stale copy
+			slog.WarnContext(ctx, "could not remove relocated object from old cell", "path", fullpath, "cell", entry.CellId, "error", deleteErr)
+		}
+	}
+	return updated, nil
+}
+
+// putObject stores an object whether it exists or not, replacing it (or
+// adding a version on top of it) if it does
+func putObject(ctx context.Context, conn *DBConnectionContext, category string, fullpath string, payload string, meta ObjectMeta) (Directory, error) {
+	if isVersioned(conn, category, fullpath) {
+		return storeVersion(ctx, conn, category, fullpath, payload, meta)
+	}
+	_, err := getDirectoryEntryCellId(ctx, conn, category, fullpath)
+	if err == nil {
+		return updateObject(ctx, conn, category, fullpath, payload, meta)
+	}
+	entry, err := createObject(ctx, conn, category, fullpath, payload, meta)
+	if err == errExists {
+		// somebody else created it in the meantime
+		return updateObject(ctx, conn, category, fullpath, payload, meta)
+	}
+	return entry, err
+}
+
+// readObject fetches the value of a directory entry from its cell, and
+// decrypts it if it was stored encrypted
+func readObject(ctx context.Context, entry Directory) (string, error) {
+	value, _, err := cellRead(ctx, entry.Key, entry.CellId)
+	if err != nil {
+		return "", err
+	}
+	payload, err := openPayload(entry.Key, value.Value, entry.Envelope)
+	if err != nil {
+		return "", err
+	}
+	return payload, verifyChecksum(ctx, entry.Key, payload, entry.Checksum)
+}
+
+func deleteObject(ctx context.Context, conn *DBConnectionContext, category string, fullpath string) (Directory, error) {
+	leave, err := enterWrite()
+	if err != nil {
+		return Directory{}, err
+	}
+	defer leave()
+	entry, err := commitDelete(ctx, conn, category, fullpath)
+	if err != nil {
+		return entry, err
+	}
+	deleteErr := CellDelete(ctx, category, entry.Key, entry.CellId)
+	if deleteErr != nil {
+		// the object is still on the cell, so put the directory entry and the accounting back
+		slog.WarnContext(ctx, "could not delete object from cell", "path", fullpath, "cell", entry.CellId, "error", deleteErr)
+		undoErr := commitStore(ctx, conn, entry)
+		if undoErr != nil {
+			slog.ErrorContext(ctx, "could not undo delete", "path", fullpath, "error", undoErr)
+		}
+		return entry, deleteErr
+	}
+	return entry, nil
+}
+
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+//																														//
+// Versioning functions																									//
+//																														//
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+// In a versioned category every store writes a new version next to the
+// old ones, each with its own cell placement and its own key on that cell,
+// and a delete only adds a tombstone. Old versions keep using cell space
+// until they are purged one by one.
+
+// versionKey is the key an object version lives under on its cell. Cells
+// know nothing about categories and take keys as a single path segment, so
+// anything outside the default category, or with a path that would not
+// survive the trip or that cells refuse, gets a key derived from a hash of
+// both instead. So does a path with an @, which could otherwise be the key
+// of another path's version.
+func versionKey(category string, fullpath string, version int64) string {
+	key := fullpath
+	if category != "default" || strings.ContainsAny(fullpath, "/%?#@\\") || strings.Contains(fullpath, "..") {
+		sum := sha256.Sum256([]byte(category + "/" + fullpath))
+		key = hex.EncodeToString(sum[:16])
+	}
+	if version == 0 {
+		return key
+	}
+	return key + "@" + strconv.FormatInt(version, 10)
+}
+
+// isVersioned also says yes when the object's current version is a
+// tombstone, since only the versioned path knows how to write on top of it
+func isVersioned(conn *DBConnectionContext, category string, fullpath string) bool {
+	settings, err := getCategory(conn, category)
+	if err == nil && settings.Versioning {
+		return true
+	}
+	entry, err := getDirectoryEntry(conn, category, fullpath)
+	return err == nil && entry.Deleted
+}
+
+func storeVersion(ctx context.Context, conn *DBConnectionContext, category string, fullpath string, payload string, meta ObjectMeta) (Directory, error) {
+	leave, err := enterWrite()
+	if err != nil {
+		return Directory{}, err
+	}
+	defer leave()
+	var previous *Directory
+	version := int64(1)
+	current, err := getDirectoryEntry(conn, category, fullpath)
+	if err == nil {
+		previous = &current
+		version = current.Version + 1
+		if !current.Deleted {
+			meta.Created = current.Created
+		}
+	} else if err != mongo.ErrNoDocuments {
+		return Directory{}, err
+	}
+	key := versionKey(category, fullpath, version)
+	stored, envelope, err := sealPayload(key, payload)
+	if err != nil {
+		return Directory{}, err
+	}
+	size := int64(len(stored))
+	releaseQuota, err := reserveQuota(ctx, conn, category, size, 1)
+	if err != nil {
+		return Directory{}, err
+	}
+	defer releaseQuota()
+	cellid, release, err := admitStore(ctx, conn, size, "version")
+	if err != nil {
+		return Directory{}, err
+	}
+	entry := Directory{Category: category, Path: fullpath, Size: size, CellId: cellid,
+		Key: key, Version: version, Current: true, Envelope: envelope, ObjectMeta: meta}
+	slog.DebugContext(ctx, "storing version", "path", fullpath, "version", version, "cell", cellid)
+	err = commitVersion(ctx, conn, previous, entry)
+	release()
+	releaseQuota()
+	if err != nil {
+		return Directory{}, err
+	}
+	err = CellPost(ctx, category, entry.Key, stored, cellid)
+	if err != nil {
+		undoErr := rollbackVersion(ctx, conn, previous, entry)
+		if undoErr != nil {
+			slog.ErrorContext(ctx, "could not undo version", "path", fullpath, "version", version, "error", undoErr)
+		}
+		return Directory{}, err
+	}
+	return entry, nil
+}
+
+func deleteVersion(ctx context.Context, conn *DBConnectionContext, category string, fullpath string) (Directory, error) {
+	leave, err := enterWrite()
+	if err != nil {
+		return Directory{}, err
+	}
+	defer leave()
+	current, err := getDirectoryEntry(conn, category, fullpath)
+	if err != nil {
+		return Directory{}, err
+	}
+	if current.Deleted {
+		return Directory{}, mongo.ErrNoDocuments
+	}
+	now := time.Now().UTC()
+	tombstone := Directory{Category: category, Path: fullpath, CellId: -1,
+		Key: versionKey(category, fullpath, current.Version+1), Version: current.Version + 1, Current: true, Deleted: true,
+		ObjectMeta: ObjectMeta{Created: now, Modified: now}}
+	return tombstone, commitVersion(ctx, conn, &current, tombstone)
+}
+
+// purgeVersion drops an old version for good and gives its space back;
+// the current version can only be replaced or deleted, not purged
+func purgeVersion(ctx context.Context, conn *DBConnectionContext, category string, fullpath string, version int64) (Directory, error) {
+	leave, err := enterWrite()
+	if err != nil {
+		return Directory{}, err
+	}
+	defer leave()
+	entry, err := commitPurge(ctx, conn, category, fullpath, version)
+	if err != nil || entry.Deleted {
+		return entry, err
+	}
+	deleteErr := CellDelete(ctx, category, entry.Key, entry.CellId)
+	if deleteErr != nil {
+		slog.WarnContext(ctx, "could not delete version from cell", "path", fullpath, "version", version, "cell", entry.CellId, "error", deleteErr)
+		undoErr := commitStore(ctx, conn, entry)
+		if undoErr != nil {
+			slog.ErrorContext(ctx, "could not undo purge", "path", fullpath, "version", version, "error", undoErr)
+		}
+		return entry, deleteErr
+	}
+	return entry, nil
+}
+
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+//																														//
+// Cell functions																										//
+//																														//
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func InitializeNewCell() int64 {
+	return int64(cellCapacity)
+}
+
+// CellDelete does not mind keys the cell does not have
+func CellDelete(ctx context.Context, category string, id string, cellid int) error {
+	err := cellCall(ctx, cellid, true, cellWriteTimeout, func(ctx context.Context) error {
+		if useCellGrpc() {
+			return grpcCellDelete(ctx, id, cellid)
+		}
+		_, err := cellRequest(ctx, cellid, "DELETE", makeCellURL(cellid)+"/"+id+"/_", "")
+		return err
+	})
+	if errors.Is(err, errNotOnCell) {
+		return nil
+	}
+	return err
+}
+
+func GetCellContents(ctx context.Context, cellid int) (*CellContents, error) {
+	contents := new(CellContents)
+	err := cellCall(ctx, cellid, true, cellListTimeout, func(ctx context.Context) error {
+		if useCellGrpc() {
+			var err error
+			contents, err = grpcCellContents(ctx, cellid)
+			return err
+		}
+		body, err := cellRequest(ctx, cellid, "GET", makeCellURL(cellid)+"/contents", "")
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(body, &contents)
+	})
+	if err != nil {
+		slog.WarnContext(ctx, "could not list cell contents", "cell", cellid, "error", err)
+		return nil, err
+	}
+	return contents, nil
+}
+
+// CellValue is what a cell answers when asked for an object
+type CellValue struct {
+	Result   string `json:"result"`
+	Value    string `json:"value"`
+	Checksum string `json:"checksum"`
+}
+
+func cellRead(ctx context.Context, id string, cellid int) (CellValue, string, error) {
+	var value CellValue
+	var body []byte
+	err := cellCall(ctx, cellid, true, cellReadTimeout, func(ctx context.Context) error {
+		var err error
+		if useCellGrpc() {
+			value, err = grpcCellRead(ctx, id, cellid)
+			if err != nil {
+				return err
+			}
+			// callers get the same answer the REST API would have given
+			body, err = json.Marshal(value)
+			return err
+		}
+		body, err = cellRequest(ctx, cellid, "GET", makeCellURL(cellid)+"/"+id+"/_", "")
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(body, &value)
+	})
+	if err != nil {
+		return value, "", err
+	}
+	if value.Result != "OK" {
+		return value, "", fmt.Errorf("cell %d does not have %s: %w", cellid, id, errNotOnCell)
+	}
+	return value, string(body), nil
+}
+
+// CellGet returns the cell's answer for id once the value in it has been
+// checked against the checksum we recorded when it was stored. For values
+// stored encrypted, the answer is made up again with the decrypted value.
+func CellGet(ctx context.Context, category string, id string, checksum string, envelope *Envelope, cellid int) (string, error) {
+	value, body, err := cellRead(ctx, id, cellid)
+	if err != nil {
+		return "", err
+	}
+	if envelope != nil {
+		value.Value, err = openPayload(id, value.Value, envelope)
+		if err != nil {
+			return "", err
+		}
+		value.Checksum = Checksum(value.Value)
+		res, _ := json.Marshal(value)
+		body = string(res)
+	}
+	err = verifyChecksum(ctx, id, value.Value, checksum)
+	if err != nil {
+		return "", err
+	}
+	return body, nil
+}
+
+// CellPost is only tried once; whoever called it undoes the directory
+// change when it fails, and a late retry could race with that
+func CellPost(ctx context.Context, category string, id string, payload string, cellid int) error {
+	return cellWrite(ctx, id, payload, false, cellid)
+}
+
+// CellPut replaces a value the cell already has, which is safe to repeat
+func CellPut(ctx context.Context, category string, id string, payload string, cellid int) error {
+	return cellWrite(ctx, id, payload, true, cellid)
+}
+
+// cellWrite sends the payload's checksum along so that the cell can refuse
+// anything that got mangled on the way and keep the checksum next to it
+func cellWrite(ctx context.Context, id string, payload string, update bool, cellid int) (err error) {
+	name := "CellPost"
+	if update {
+		name = "CellPut"
+	}
+	ctx, span := tracer.Start(ctx, name, trace.WithAttributes(attribute.String("eks.key", id),
+		attribute.Int("eks.bytes", len(payload)), cellAttribute(cellid)))
+	defer func() { endSpan(span, err) }()
+	err = cellCall(ctx, cellid, update, cellWriteTimeout, func(ctx context.Context) error {
+		if useCellGrpc() {
+			return grpcCellWrite(ctx, id, payload, update, cellid)
+		}
+		method := "POST"
+		if update {
+			method = "PUT"
+		}
+		_, err := cellRequest(ctx, cellid, method, makeCellURL(cellid)+"/"+id+"/"+payload, Checksum(payload))
+		return err
+	})
+	if errors.Is(err, errCellFull) {
+		slog.WarnContext(ctx, "cell has less room than cellstatus says, fsck will put it right", "cell", cellid, "size", len(payload))
+	}
+	return err
+}
+
+// CopyCell verifies the value against the checksum the source cell kept
+// for it, and reads the copy back from the destination to check it again.
+// Encrypted values are copied as they are: their data key is in the
+// directory and they are bound to the key, not to the cell.
+func CopyCell(ctx context.Context, category string, id string, fromcell int, tocell int) error {
+	value, _, err := cellRead(ctx, id, fromcell)
+	if err != nil {
+		return err
+	}
+	err = verifyChecksum(ctx, id, value.Value, value.Checksum)
+	if err != nil {
+		return err
+	}
+	err = CellPost(ctx, category, id, value.Value, tocell)
+	if err != nil {
+		return err
+	}
+	copied, _, err := cellRead(ctx, id, tocell)
+	if err != nil {
+		return err
+	}
+	return verifyChecksum(ctx, id, copied.Value, Checksum(value.Value))
+}
+
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+//																														//
+// Kubernetes functions																									//
+//																														//
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func ScaleStatefulSet(toSize int) error {
+	//fmt.Println("  >> scaling stateful set to size " + strconv.Itoa(toSize))
+	sts, err := clientset.AppsV1().StatefulSets("default").Get(StatefulSetName, metav1.GetOptions{})
+	if err == nil {
+		*sts.Spec.Replicas = int32(toSize)
+		_, err := clientset.AppsV1().StatefulSets("default").Update(sts)
+		if err != nil {
+			return err
+		} else {
+			return nil
+		}
+	} else {
+		return err
+	}
+	//return nil
 }
 
 func PrunePVC(toAmount int) error {
@@ -458,139 +1585,749 @@ func PrunePVC(toAmount int) error {
 				return deleteErr
 			}
 		}
-		return nil
+		return nil
+	}
+	//return nil
+}
+
+func WaitForPod(ctx context.Context, podname string, podstatus string) {
+	if podstatus == "Not exists" {
+		podstatus = ""
+	}
+	slog.InfoContext(ctx, "waiting for pod", "pod", podname, "phase", podstatus)
+	time.Sleep(5 * time.Second)
+	pod, err := clientset.CoreV1().Pods("default").Get(podname, metav1.GetOptions{})
+	for err != nil {
+		if podstatus == "" {
+			slog.InfoContext(ctx, "pod is gone", "pod", podname)
+			return
+		}
+		slog.WarnContext(ctx, "could not get pod, retrying in 10 seconds", "pod", podname, "error", err)
+		time.Sleep(10 * time.Second)
+		pod, err = clientset.CoreV1().Pods("default").Get(podname, metav1.GetOptions{})
+	}
+	for string(pod.Status.Phase) != podstatus {
+		slog.DebugContext(ctx, "pod not there yet, retrying in 10 seconds", "pod", podname, "phase", string(pod.Status.Phase))
+		time.Sleep(10 * time.Second)
+		pod, err = clientset.CoreV1().Pods("default").Get(podname, metav1.GetOptions{})
+	}
+	slog.InfoContext(ctx, "pod ready", "pod", podname, "phase", podstatus)
+}
+
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+//																														//
+// State functions																										//
+//																														//
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func ScaleUp(ctx context.Context, conn *DBConnectionContext) {
+	if ServerState == SNAFU {
+		slog.InfoContext(ctx, "scaling up", "cells", serverstatus.NumberOfCells+1)
+		ServerState = ScalingUp
+		startOperation("scaleup")
+		start := time.Now()
+		targetSize := serverstatus.NumberOfCells + 1
+		err := ScaleStatefulSet(targetSize)
+		if err != nil {
+			slog.ErrorContext(ctx, "could not scale the stateful set", "error", err)
+			scaleEvents.WithLabelValues("up", "error").Inc()
+			finishOperation("failed", err)
+			ServerState = SNAFU
+			return
+		} else {
+			podname := StatefulSetName + "-" + strconv.Itoa(targetSize-1)
+			WaitForPod(ctx, podname, "Running")
+			serverstatus.NumberOfCells = serverstatus.NumberOfCells + 1
+			serverstatus.TotalSpace += int64(cellCapacity)
+			err = pushServerStatus(&dbConnectionContext)
+			if err != nil {
+				slog.ErrorContext(ctx, "could not save server status", "error", err)
+				scaleEvents.WithLabelValues("up", "error").Inc()
+				finishOperation("failed", err)
+				ServerState = SNAFU
+				return
+			}
+			cellcapacity := InitializeNewCell()
+			_, err = conn.cellstatus.InsertOne(context.TODO(), bson.D{{"_id", targetSize - 1},
+				{"freespace", cellcapacity}, {"capacity", cellcapacity}, {"numberoffiles", 0}})
+			if err != nil {
+				slog.ErrorContext(ctx, "could not record the new cell", "cell", targetSize-1, "error", err)
+			}
+			slog.InfoContext(ctx, "scaled up", "cells", serverstatus.NumberOfCells)
+			scaleEvents.WithLabelValues("up", "ok").Inc()
+			finishOperation("ok", nil)
+			scaleUpFinished(time.Since(start))
+		}
+		ServerState = SNAFU
+	}
+}
+
+func ScaleDown(ctx context.Context, conn *DBConnectionContext) {
+	if ServerState == Draining {
+		ServerState = ScalingDown
+		startOperation("scaledown")
+		targetSize := serverstatus.NumberOfCells - 1
+		err := ScaleStatefulSet(targetSize)
+		if err != nil {
+			slog.ErrorContext(ctx, "could not scale the stateful set", "error", err)
+			scaleEvents.WithLabelValues("down", "error").Inc()
+			finishOperation("failed", err)
+			ServerState = SNAFU
+			return
+		} else {
+			podname := StatefulSetName + "-" + strconv.Itoa(targetSize)
+			WaitForPod(ctx, podname, "Not exists")
+			pruneErr := PrunePVC(targetSize)
+			if pruneErr != nil {
+				slog.WarnContext(ctx, "could not prune volume claims", "error", pruneErr)
+			}
+			serverstatus.NumberOfCells = serverstatus.NumberOfCells - 1
+			serverstatus.TotalSpace -= int64(cellCapacity)
+			err = pushServerStatus(&dbConnectionContext)
+			if err != nil {
+				slog.ErrorContext(ctx, "could not save server status", "error", err)
+				scaleEvents.WithLabelValues("down", "error").Inc()
+				finishOperation("failed", err)
+				ServerState = SNAFU
+				return
+			}
+			_, err = conn.cellstatus.DeleteOne(context.TODO(), bson.D{{"_id", targetSize}})
+			slog.InfoContext(ctx, "scaled down", "cells", serverstatus.NumberOfCells)
+			scaleEvents.WithLabelValues("down", "ok").Inc()
+			finishOperation("ok", nil)
+			ServerState = SNAFU
+		}
+	}
+}
+
+func CheckScaleUp(ctx context.Context, conn *DBConnectionContext) {
+	if (serverstatus.TotalSpace - serverstatus.UsedSpace) < serverstatus.SUT {
+		if ServerState == SNAFU {
+			slog.InfoContext(ctx, "free space below scale up threshold", "free", serverstatus.TotalSpace-serverstatus.UsedSpace)
+			go ScaleUp(backgroundContext("scaleup"), conn)
+		} else {
+			slog.DebugContext(ctx, "free space below scale up threshold, but busy", "state", ServerState)
+		}
+	} else {
+		slog.DebugContext(ctx, "free space", "free", serverstatus.TotalSpace-serverstatus.UsedSpace)
+	}
+}
+
+func CheckScaleDown(ctx context.Context, conn *DBConnectionContext) {
+	if (serverstatus.TotalSpace - serverstatus.UsedSpace) > serverstatus.SDT {
+		if ServerState == SNAFU {
+			slog.InfoContext(ctx, "free space above scale down threshold", "free", serverstatus.TotalSpace-serverstatus.UsedSpace)
+			go Drain(backgroundContext("drain"), conn)
+		} else {
+			slog.DebugContext(ctx, "free space above scale down threshold, but busy", "state", ServerState)
+		}
+	} else {
+		slog.DebugContext(ctx, "free space", "free", serverstatus.TotalSpace-serverstatus.UsedSpace)
+	}
+}
+
+func CancelDrain() {
+	ServerState = SNAFU
+}
+
+func Drain(ctx context.Context, conn *DBConnectionContext) {
+	if ServerState == SNAFU {
+		drainCellId := serverstatus.NumberOfCells - 1
+		slog.InfoContext(ctx, "draining", "cell", drainCellId)
+		ServerState = Draining
+		startOperation("drain")
+		start := time.Now()
+		defer func() {
+			drainDuration.Observe(time.Since(start).Seconds())
+		}()
+		itemsToMove, err := GetCellContents(ctx, drainCellId)
+		if err != nil {
+			slog.ErrorContext(ctx, "drain cancelled, could not list the cell", "cell", drainCellId, "error", err)
+			finishOperation("failed", err)
+			CancelDrain()
+			return
+		}
+		l := len(itemsToMove.Details.Items)
+		i := 0
+		for (ServerState == Draining) && (i < l) {
+			item := itemsToMove.Details.Items[i]
+			// a repair must not see the copy without the move's commit
+			accountingGate.RLock()
+			cellid, reserved := reserveSpace(ctx, &dbConnectionContext, item.Size)
+			release := func() {
+				reserved()
+				accountingGate.RUnlock()
+			}
+			if cellid == -1 || cellid == drainCellId { // golly! this should not happen!
+				release()
+				slog.ErrorContext(ctx, "drain cancelled, no room for the rest", "cell", drainCellId, "key", item.Id, "size", item.Size)
+				finishOperation("failed", errNoSpace)
+				CancelDrain()
+				return
+			}
+			copyErr := CopyCell(ctx, "default", item.Id, drainCellId, cellid)
+			if errors.Is(copyErr, errNotOnCell) {
+				// deleted since the cell was listed
+				release()
+				slog.InfoContext(ctx, "skipped, no longer on the cell", "key", item.Id)
+				skipOperationKey()
+				i = i + 1
+				continue
+			}
+			if copyErr != nil {
+				release()
+				slog.ErrorContext(ctx, "drain cancelled, could not copy", "key", item.Id, "from", drainCellId, "to", cellid, "error", copyErr)
+				finishOperation("failed", copyErr)
+				CancelDrain()
+				return
+			}
+			moveErr := commitMove(ctx, &dbConnectionContext, item.Id, item.Size, drainCellId, cellid)
+			if moveErr == mongo.ErrNoDocuments {
+				skipMove(ctx, &dbConnectionContext, item.Id, cellid)
+			}
+			release()
+			if moveErr == mongo.ErrNoDocuments {
+				i = i + 1
+				continue
+			}
+			if moveErr != nil {
+				slog.ErrorContext(ctx, "drain cancelled, could not update the directory", "key", item.Id, "error", moveErr)
+				finishOperation("failed", moveErr)
+				CancelDrain()
+				return
+			}
+			slog.DebugContext(ctx, "moved", "key", item.Id, "from", drainCellId, "to", cellid)
+			objectsMoved.WithLabelValues("drain").Inc()
+			i = i + 1
+		}
+		if ServerState != Draining {
+			// a store needed the room on the cell being drained
+			slog.InfoContext(ctx, "drain cancelled", "cell", drainCellId, "moved", i)
+			finishOperation("cancelled", nil)
+			return
+		}
+		finishOperation("ok", nil)
+		ScaleDown(ctx, conn)
+	}
+}
+
+var errLastCell = errors.New("cannot drain the last cell")
+
+// StartDrain checks that a drain asked for by an operator can work before
+// setting it off; the drain itself takes as long as copying the cell does
+func StartDrain(ctx context.Context, conn *DBConnectionContext) (int, error) {
+	if ServerState != SNAFU {
+		return -1, errScaling
+	}
+	if serverstatus.NumberOfCells <= 1 {
+		return -1, errLastCell
+	}
+	if serverstatus.UsedSpace > serverstatus.TotalSpace-int64(cellCapacity) {
+		return -1, errNoSpace
+	}
+	// the drain outlives the request, so it gets an id of its own; this
+	// line ties the two together
+	drainCtx := backgroundContext("drain")
+	slog.InfoContext(ctx, "drain requested", "operation", requestIdFrom(drainCtx))
+	go Drain(drainCtx, conn)
+	return serverstatus.NumberOfCells - 1, nil
+}
+
+// rebalanceMaxMoves keeps a single run from shuffling data around forever
+const rebalanceMaxMoves = 1000
+
+func cellUsedSpace(status CellStatus) int64 {
+	return status.Capacity - status.FreeSpace
+}
+
+// pickRebalanceItem finds the item whose move closes the gap between two
+// cells the most, or -1 if moving any of them would not help
+func pickRebalanceItem(items []IdPayloadPair, gap int64, room int64) int {
+	best := -1
+	var bestDistance int64
+	for i, item := range items {
+		if item.Size <= 0 || item.Size >= gap || item.Size > room {
+			continue
+		}
+		distance := gap - 2*item.Size
+		if distance < 0 {
+			distance = -distance
+		}
+		if best == -1 || distance < bestDistance {
+			best = i
+			bestDistance = distance
+		}
+	}
+	return best
+}
+
+// Rebalance moves objects, one at a time, from the fullest cell to the
+// emptiest until no single move would even them out any further. Cells
+// added by a scale up start out empty and only fill with new objects, so
+// this is the way to spread the old ones over them.
+func Rebalance(ctx context.Context, conn *DBConnectionContext) {
+	if ServerState != SNAFU {
+		return
+	}
+	slog.InfoContext(ctx, "rebalancing")
+	ServerState = Rebalancing
+	startOperation("rebalance")
+	var failure error
+	moves := 0
+	skipped := make(map[string]bool)
+	for (ServerState == Rebalancing) && (moves+len(skipped) < rebalanceMaxMoves) {
+		statuses, err := getCellStatuses(conn)
+		if err != nil {
+			slog.ErrorContext(ctx, "rebalance stopped, could not read cell statuses", "error", err)
+			failure = err
+			break
+		}
+		fromcell, tocell := -1, -1
+		for cellid := 0; cellid < serverstatus.NumberOfCells; cellid++ {
+			status, exists := statuses[cellid]
+			if !exists {
+				continue
+			}
+			if fromcell == -1 || cellUsedSpace(status) > cellUsedSpace(statuses[fromcell]) {
+				fromcell = cellid
+			}
+			if tocell == -1 || cellUsedSpace(status) < cellUsedSpace(statuses[tocell]) {
+				tocell = cellid
+			}
+		}
+		if fromcell == tocell {
+			break
+		}
+		contents, err := GetCellContents(ctx, fromcell)
+		if err != nil {
+			slog.ErrorContext(ctx, "rebalance stopped, could not list the cell", "cell", fromcell, "error", err)
+			failure = err
+			break
+		}
+		items := contents.Details.Items[:0]
+		for _, item := range contents.Details.Items {
+			if !skipped[item.Id] {
+				items = append(items, item)
+			}
+		}
+		gap := cellUsedSpace(statuses[fromcell]) - cellUsedSpace(statuses[tocell])
+		i := pickRebalanceItem(items, gap, statuses[tocell].FreeSpace)
+		if i == -1 {
+			break
+		}
+		item := items[i]
+		// stores may have taken the room since the statuses were read; and
+		// a repair must not see the copy without the move's commit
+		accountingGate.RLock()
+		fits, reserved, err := reserveSpaceOn(ctx, conn, tocell, item.Size)
+		release := func() {
+			reserved()
+			accountingGate.RUnlock()
+		}
+		if err != nil || !fits {
+			release()
+			failure = err
+			break
+		}
+		copyErr := CopyCell(ctx, "default", item.Id, fromcell, tocell)
+		if errors.Is(copyErr, errNotOnCell) {
+			release()
+			slog.InfoContext(ctx, "skipped, no longer on the cell", "key", item.Id)
+			skipOperationKey()
+			skipped[item.Id] = true
+			continue
+		}
+		if copyErr != nil {
+			release()
+			slog.ErrorContext(ctx, "rebalance stopped, could not copy", "key", item.Id, "from", fromcell, "to", tocell, "error", copyErr)
+			failure = copyErr
+			break
+		}
+		moveErr := commitMove(ctx, &dbConnectionContext, item.Id, item.Size, fromcell, tocell)
+		if moveErr == mongo.ErrNoDocuments {
+			skipMove(ctx, &dbConnectionContext, item.Id, tocell)
+		}
+		release()
+		if moveErr == mongo.ErrNoDocuments {
+			skipped[item.Id] = true
+			continue
+		}
+		if moveErr != nil {
+			slog.ErrorContext(ctx, "rebalance stopped, could not update the directory", "key", item.Id, "error", moveErr)
+			failure = moveErr
+			break
+		}
+		slog.DebugContext(ctx, "moved", "key", item.Id, "from", fromcell, "to", tocell)
+		objectsMoved.WithLabelValues("rebalance").Inc()
+		// the directory points at the new copy now, so a leftover on the old
+		// cell is only an orphan for fsck to pick up
+		deleteErr := CellDelete(ctx, "default", item.Id, fromcell)
+		if deleteErr != nil {
+			slog.WarnContext(ctx, "could not remove moved object from old cell", "key", item.Id, "cell", fromcell, "error", deleteErr)
+		}
+		moves = moves + 1
+	}
+	slog.InfoContext(ctx, "rebalance done", "moves", moves, "skipped", len(skipped))
+	if failure != nil {
+		finishOperation("failed", failure)
+	} else if ServerState != Rebalancing {
+		finishOperation("cancelled", nil)
+	} else {
+		finishOperation("ok", nil)
+	}
+	if ServerState == Rebalancing {
+		ServerState = SNAFU
+	}
+}
+
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+//																														//
+// Reconciliation functions																								//
+//																														//
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+// UsedSpace, the per-cell counters and the directory are all maintained by
+// independent increments, so every now and then we compare them against
+// what the cells really hold and optionally put things right.
+
+// FsckItem has no category or path for orphans, as cells only know keys
+type FsckItem struct {
+	Category string `json:"category,omitempty"`
+	Path     string `json:"path,omitempty"`
+	Key      string `json:"key"`
+	Size     int64  `json:"size"`
+	CellId   int    `json:"cellid"`
+}
+
+type FsckReport struct {
+	Repair           bool            `json:"repair"`
+	CellsChecked     int             `json:"cellschecked"`
+	UnreachableCells []int           `json:"unreachablecells"`
+	Orphans          []FsckItem      `json:"orphans"`
+	Dangling         []FsckItem      `json:"dangling"`
+	CellStatus       []CellStatus    `json:"cellstatus"`
+	Categories       []CategoryUsage `json:"categories"`
+	UsedSpace        int64           `json:"usedspace"`
+	TotalSpace       int64           `json:"totalspace"`
+	Errors           []string        `json:"errors"`
+}
+
+var fsckLock sync.Mutex
+
+func getDirectoryEntries(conn *DBConnectionContext) ([]Directory, error) {
+	var entries []Directory
+	cursor, err := conn.directories.Find(context.TODO(), bson.D{{}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+	err = cursor.All(context.TODO(), &entries)
+	return entries, err
+}
+
+func getCellStatuses(conn *DBConnectionContext) (map[int]CellStatus, error) {
+	statuses := make(map[int]CellStatus)
+	cursor, err := conn.cellstatus.Find(context.TODO(), bson.D{{}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(context.TODO())
+	for cursor.Next(context.TODO()) {
+		var elem CellStatus
+		if err := cursor.Decode(&elem); err != nil {
+			return nil, err
+		}
+		statuses[elem.CellId] = elem
+	}
+	return statuses, cursor.Err()
+}
+
+var errFsckRunning = errors.New("fsck already running")
+var errScaling = errors.New("cells are being scaled, try again later")
+var errRepairing = errors.New("fsck is repairing the usage counts, try again shortly")
+
+// accountingGate keeps writes out while fsck repairs. A repair rewrites the
+// counters from a snapshot of the directory, so a write committed between
+// the two would be lost from them; every write holds the gate shared from
+// before it reserves room until it has committed, and a repair holds it
+// alone from its snapshot to its rewrite.
+var accountingGate sync.RWMutex
+
+// enterWrite turns a write away, rather than have it wait, while a repair
+// runs; the function it returns lets the gate go
+func enterWrite() (func(), error) {
+	if !accountingGate.TryRLock() {
+		return nil, errRepairing
+	}
+	return accountingGate.RUnlock, nil
+}
+
+// longer than a store takes between committing its directory entry and
+// the cell answering, retries and all
+const fsckGracePeriod = 5 * time.Minute
+
+// Fsck pulls the contents of every cell and compares them with the
+// directories collection. Orphans are objects a cell holds without a
+// directory entry; dangling entries point at a cell that does not hold the
+// object. Entries written in the last fsckGracePeriod are not taken for
+// dangling, as their store may still be on its way to the cell. With repair
+// set, dangling entries are dropped, orphans are deleted if the directory
+// has that key on another cell, and cellstatus/serverstatus, and the usage
+// counts of the categories, are rewritten from the result. Writes are
+// turned away with errRepairing while a repair runs, see accountingGate.
+//
+// Other orphans are only reported. A store writes to its cell before its
+// directory entry, so one may be a store still under way; and a cell key
+// alone does not say which object it was, nor how to read it, for hashed,
+// versioned or encrypted ones. They take room on their cell all the same.
+
+func Fsck(ctx context.Context, conn *DBConnectionContext, repair bool) (*FsckReport, error) {
+	if !fsckLock.TryLock() {
+		return nil, errFsckRunning
+	}
+	defer fsckLock.Unlock()
+
+	if ServerState != SNAFU {
+		return nil, errScaling
+	}
+
+	if repair {
+		accountingGate.Lock()
+		defer accountingGate.Unlock()
+	}
+
+	report := &FsckReport{Repair: repair}
+	statuses, err := getCellStatuses(conn)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := getDirectoryEntries(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	// cellid -> object id -> size, as reported by the cells themselves
+	cellObjects := make(map[int]map[string]int64)
+	for cellid := 0; cellid < serverstatus.NumberOfCells; cellid++ {
+		contents, err := GetCellContents(ctx, cellid)
+		if err != nil {
+			report.UnreachableCells = append(report.UnreachableCells, cellid)
+			continue
+		}
+		objects := make(map[string]int64)
+		for _, item := range contents.Details.Items {
+			objects[item.Id] = item.Size
+		}
+		cellObjects[cellid] = objects
+		report.CellsChecked++
+	}
+
+	usedPerCell := make(map[int]int64)
+	filesPerCell := make(map[int]int64)
+	usedPerCategory := make(map[string]int64)
+	objectsPerCategory := make(map[string]int64)
+	confirmed := make(map[string]bool)
+	for _, entry := range entries {
+		if entry.Deleted {
+			// tombstones have nothing on any cell
+			continue
+		}
+		objects, reachable := cellObjects[entry.CellId]
+		_, onCell := objects[entry.Key]
+		if !reachable || !onCell && time.Since(entry.Modified) < fsckGracePeriod {
+			// we cannot tell, or the store that wrote the entry may not
+			// have reached the cell yet, so trust the directory
+			usedPerCell[entry.CellId] += entry.Size
+			filesPerCell[entry.CellId]++
+			usedPerCategory[entry.Category] += entry.Size
+			objectsPerCategory[entry.Category]++
+			continue
+		}
+		size, found := objects[entry.Key]
+		if !found {
+			report.Dangling = append(report.Dangling, FsckItem{entry.Category, entry.Path, entry.Key, entry.Size, entry.CellId})
+			if repair {
+				// only if nobody has written the object since we looked
+				_, err := conn.directories.DeleteOne(ctx, bson.D{
+					{"key", entry.Key}, {"cellid", entry.CellId}, {"modified", entry.Modified}})
+				if err != nil {
+					report.Errors = append(report.Errors, err.Error())
+				}
+			} else {
+				usedPerCell[entry.CellId] += entry.Size
+				filesPerCell[entry.CellId]++
+				usedPerCategory[entry.Category] += entry.Size
+				objectsPerCategory[entry.Category]++
+			}
+			continue
+		}
+		delete(objects, entry.Key)
+		confirmed[entry.Key] = true
+		usedPerCell[entry.CellId] += size
+		filesPerCell[entry.CellId]++
+		usedPerCategory[entry.Category] += size
+		objectsPerCategory[entry.Category]++
+	}
+
+	// whatever is left on a cell has no directory entry pointing at it
+	for cellid, objects := range cellObjects {
+		for id, size := range objects {
+			report.Orphans = append(report.Orphans, FsckItem{Key: id, Size: size, CellId: cellid})
+			if repair && confirmed[id] {
+				// a leftover copy, the directory already points at a good
+				// one, unless an update has moved the object here since
+				entry, err := getDirectoryEntryByKey(conn, id)
+				if err == nil && entry.CellId != cellid {
+					if err := CellDelete(ctx, "default", id, cellid); err != nil {
+						report.Errors = append(report.Errors, err.Error())
+					}
+					continue
+				}
+			}
+			usedPerCell[cellid] += size
+			filesPerCell[cellid]++
+		}
+	}
+
+	// every category is rewritten, so one emptied since is set back to 0
+	categories, err := getCategories(conn)
+	if err != nil {
+		return nil, err
+	}
+	for _, category := range categories {
+		report.Categories = append(report.Categories, CategoryUsage{category.Name, usedPerCategory[category.Name],
+			objectsPerCategory[category.Name], category.MaxBytes, category.MaxObjects})
+		delete(usedPerCategory, category.Name)
+	}
+	for name, used := range usedPerCategory {
+		report.Categories = append(report.Categories, CategoryUsage{Category: name, UsedBytes: used, Objects: objectsPerCategory[name]})
+	}
+
+	for cellid := 0; cellid < serverstatus.NumberOfCells; cellid++ {
+		status, known := statuses[cellid]
+		if !known {
+			status = CellStatus{CellId: cellid, Capacity: InitializeNewCell()}
+		}
+		status.FreeSpace = status.Capacity - usedPerCell[cellid]
+		status.NumberOfFiles = filesPerCell[cellid]
+		report.CellStatus = append(report.CellStatus, status)
+		report.UsedSpace += usedPerCell[cellid]
+		report.TotalSpace += status.Capacity
+	}
+
+	if repair {
+		err = runTransaction(ctx, conn, func(ctx context.Context) error {
+			for _, status := range report.CellStatus {
+				// room reserved by stores in flight stays taken, as of the
+				// moment of the write
+				_, err := conn.cellstatus.UpdateOne(ctx, bson.D{{"_id", status.CellId}},
+					mongo.Pipeline{{{"$set", bson.D{
+						{"freespace", bson.D{{"$subtract", bson.A{status.FreeSpace, bson.D{{"$ifNull", bson.A{"$reserved", 0}}}}}}},
+						{"capacity", status.Capacity}, {"numberoffiles", status.NumberOfFiles}}}}},
+					options.Update().SetUpsert(true))
+				if err != nil {
+					return err
+				}
+			}
+			for _, usage := range report.Categories {
+				// and so does quota reserved by stores in flight
+				_, err := conn.categories.UpdateOne(ctx, bson.D{{"_id", usage.Category}},
+					mongo.Pipeline{{{"$set", bson.D{
+						{"usedbytes", bson.D{{"$add", bson.A{usage.UsedBytes, bson.D{{"$ifNull", bson.A{"$reservedbytes", 0}}}}}}},
+						{"objects", bson.D{{"$add", bson.A{usage.Objects, bson.D{{"$ifNull", bson.A{"$reservedobjects", 0}}}}}}},
+						{"created", bson.D{{"$ifNull", bson.A{"$created", time.Now().UTC()}}}}}}}},
+					options.Update().SetUpsert(true))
+				if err != nil {
+					return err
+				}
+			}
+			_, err := conn.serverstatus.UpdateOne(ctx, bson.D{{"_id", 0}},
+				bson.D{{"$set", bson.D{
+					{"usedspace", report.UsedSpace}, {"totalspace", report.TotalSpace}}}})
+			return err
+		})
+		if err != nil {
+			return report, err
+		}
+		serverstatus.UsedSpace = report.UsedSpace
+		serverstatus.TotalSpace = report.TotalSpace
 	}
-	//return nil
+
+	slog.InfoContext(ctx, "fsck done", "orphans", len(report.Orphans), "dangling", len(report.Dangling), "repair", repair)
+	return report, nil
 }
 
-func WaitForPod(podname string, podstatus string) {
-	if podstatus == "Not exists" {
-		podstatus = ""
-	}
-	fmt.Println("  >> Starting wait for pod " + podname + " to become " + podstatus)
-	time.Sleep(5 * time.Second)
-	pod, err := clientset.CoreV1().Pods("default").Get(podname, metav1.GetOptions{})
-	for err != nil {
-		if podstatus == "" {
-			fmt.Println("  >> Pod does not exist ")
-			return
+func PeriodicFsck(conn *DBConnectionContext, interval time.Duration, repair bool) {
+	for {
+		time.Sleep(interval)
+		ctx := backgroundContext("fsck")
+		_, err := Fsck(ctx, conn, repair)
+		if err != nil {
+			slog.WarnContext(ctx, "periodic fsck failed", "error", err)
 		}
-		fmt.Println("There was an error! " + err.Error() + ", retrying in 10 seconds...")
-		time.Sleep(10 * time.Second)
-		pod, err = clientset.CoreV1().Pods("default").Get(podname, metav1.GetOptions{})
-	}
-	for string(pod.Status.Phase) != podstatus {
-		fmt.Println("  >> Pod is not " + podstatus + ", rather it is " + string(pod.Status.Phase) + ",  delaying 10 seconds....")
-		time.Sleep(10 * time.Second)
-		pod, err = clientset.CoreV1().Pods("default").Get(podname, metav1.GetOptions{})
 	}
-	fmt.Println("  >> Pod is " + podstatus)
 }
 
 //////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 //																														//
-// State functions																										//
+// Repair functions																										//
 //																														//
 //////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 
-func ScaleUp(conn *DBConnectionContext) {
-	if ServerState == SNAFU {
-		fmt.Println("Starting scale up...")
-		ServerState = ScalingUp
-		targetSize := serverstatus.NumberOfCells + 1
-		err := ScaleStatefulSet(targetSize)
+// Cells scrub their volumes and tell us about files that no longer match
+// their checksum. We keep a single copy of every object on purpose, but
+// drains and relocations can leave copies behind on other cells, and any of
+// those whose checksum still matches the directory is good enough to put
+// the object right.
+
+// number of corrupt objects reported by the cells since start
+var corruptionsReported int64
+
+func repairFromReplica(ctx context.Context, conn *DBConnectionContext, key string, cellid int) (string, error) {
+	entry, err := getDirectoryEntryByKey(conn, key)
+	if err != nil {
+		return "", err
+	}
+	for other := 0; other < serverstatus.NumberOfCells; other++ {
+		if other == cellid {
+			continue
+		}
+		value, _, err := cellRead(ctx, key, other)
 		if err != nil {
-			fmt.Println("Error scaling sts")
-			ServerState = SNAFU
-			return
-		} else {
-			podname := StatefulSetName + "-" + strconv.Itoa(targetSize-1)
-			fmt.Println("About to call WaitForPod(" + podname + ")")
-			WaitForPod(podname, "Running")
-			serverstatus.NumberOfCells = serverstatus.NumberOfCells + 1
-			serverstatus.TotalSpace += int64(cellCapacity)
-			fmt.Println("  attempting to update serverstatus...")
-			fmt.Println(serverstatus)
-			err = pushServerStatus(&dbConnectionContext)
-			if err != nil {
-				fmt.Println("Error pushing server status")
-				ServerState = SNAFU
-				return
-			}
-			cellcapacity := InitializeNewCell()
-			_, err = conn.cellstatus.InsertOne(context.TODO(), bson.D{{"_id", targetSize - 1},
-				{"freespace", cellcapacity}, {"capacity", cellcapacity}, {"numberoffiles", 0}})
+			continue
 		}
-		ServerState = SNAFU
-	}
-}
-
-func ScaleDown(conn *DBConnectionContext) {
-	if ServerState == Draining {
-		ServerState = ScalingDown
-		targetSize := serverstatus.NumberOfCells - 1
-		err := ScaleStatefulSet(targetSize)
+		// a copy left behind by an earlier write of an encrypted object
+		// does not open with the current data key
+		payload, err := openPayload(key, value.Value, entry.Envelope)
+		if err != nil || Checksum(payload) != entry.Checksum {
+			continue
+		}
+		err = CellPut(ctx, entry.Category, key, value.Value, cellid)
 		if err != nil {
-			fmt.Println("Error scaling sts")
-			ServerState = SNAFU
-			return
-		} else {
-			podname := StatefulSetName + "-" + strconv.Itoa(targetSize)
-			WaitForPod(podname, "Not exists")
-			pruneErr := PrunePVC(targetSize)
-			if pruneErr != nil {
-				fmt.Println("  >> ScaleDown: pruneErr = " + pruneErr.Error())
-			}
-			serverstatus.NumberOfCells = serverstatus.NumberOfCells - 1
-			serverstatus.TotalSpace -= int64(cellCapacity)
-			err = pushServerStatus(&dbConnectionContext)
-			if err != nil {
-				fmt.Println("Error pushing server status")
-				ServerState = SNAFU
-				return
-			}
-			_, err = conn.cellstatus.DeleteOne(context.TODO(), bson.D{{"_id", targetSize}})
-			ServerState = SNAFU
+			return "", err
 		}
+		return "cell " + strconv.Itoa(other), nil
 	}
+	return "", errors.New("no good copy of " + key + " left")
 }
 
-func CancelDrain() {
-	ServerState = SNAFU
-}
-
-func Drain(conn *DBConnectionContext) {
-	if ServerState == SNAFU {
-		drainCellId := serverstatus.NumberOfCells - 1
-		fmt.Println("Starting drain...")
-		ServerState = Draining
-		itemsToMove, err := GetCellContents(drainCellId)
-		fmt.Println("     #### DEBUG TIME #### This is what I got as contents: ")
-		fmt.Println(itemsToMove)
+func handleCorruption(ctx context.Context, conn *DBConnectionContext, key string, cellid int, repaired bool) {
+	corruption := Corruption{Key: key, CellId: cellid, Repaired: repaired, Reported: time.Now().UTC()}
+	if repaired {
+		corruption.Source = "cell"
+	} else {
+		source, err := repairFromReplica(ctx, conn, key, cellid)
 		if err != nil {
-			fmt.Println("     >> Drain: error getting cell contents: " + err.Error())
-			CancelDrain()
-			return
-		}
-		l := len(itemsToMove.Details.Items)
-		i := 0
-		for (ServerState == Draining) && (i < l) {
-			item := itemsToMove.Details.Items[i]
-			cellid := findCellWithFreeSpace(&dbConnectionContext, item.Size)
-			if cellid == drainCellId { // golly! this should not happen!
-				fmt.Println("     >> Drain: no cellid found to move data, that's weird")
-				CancelDrain()
-				return
-			}
-			CopyCell("default", item.Id, drainCellId, cellid)
-			fmt.Println("Updating data in cell " + strconv.Itoa(cellid))
-			updateDirErr := updateDirectoryEntry(&dbConnectionContext, "default", item.Id, drainCellId, cellid)
-			if updateDirErr != nil {
-				fmt.Println("Error updating directory entries!")
-			}
-			i = i + 1
+			slog.ErrorContext(ctx, "could not repair corrupt object", "key", key, "cell", cellid, "error", err)
+		} else {
+			slog.InfoContext(ctx, "repaired corrupt object", "key", key, "cell", cellid, "source", source)
+			corruption.Repaired = true
+			corruption.Source = source
 		}
-		ScaleDown(conn)
+	}
+	err := addCorruption(conn, corruption)
+	if err != nil {
+		slog.ErrorContext(ctx, "could not record corruption", "key", key, "cell", cellid, "error", err)
 	}
 }
 
@@ -600,121 +2337,352 @@ func Drain(conn *DBConnectionContext) {
 //																														//
 //////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 
+var errBadVersion = errors.New("bad version")
+
+// getRequestedEntry looks up the version asked for in the query string, or
+// the current one, and treats tombstones as not found
+func getRequestedEntry(r *http.Request, category string, fullpath string) (Directory, error) {
+	var entry Directory
+	var err error
+	if version := r.URL.Query().Get("version"); version != "" {
+		number, parseErr := strconv.ParseInt(version, 10, 64)
+		if parseErr != nil {
+			return entry, errBadVersion
+		}
+		entry, err = getDirectoryVersion(&dbConnectionContext, category, fullpath, number)
+	} else {
+		entry, err = getDirectoryEntry(&dbConnectionContext, category, fullpath)
+	}
+	if err == nil && entry.Deleted {
+		err = mongo.ErrNoDocuments
+	}
+	return entry, err
+}
+
 func Retrieve(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	fmt.Println("  # controller # Attempting to retrieve value " + vars["id"])
-	cellid, err := getDirectoryEntryCellId(&dbConnectionContext, "default", vars["id"])
+	ctx := r.Context()
+	slog.DebugContext(ctx, "retrieving", "path", vars["id"])
+	entry, err := getRequestedEntry(r, "default", vars["id"])
 	if err != nil {
-		JSONResponseFromString(w, "{\"error\":"+err.Error()+"}")
+		JSONErrorFrom(w, r, err)
 	} else {
-		res, err := CellGet("default", vars["id"], cellid)
+		res, err := CellGet(ctx, "default", entry.Key, entry.Checksum, entry.Envelope, entry.CellId)
 		if err != nil {
-			JSONResponseFromString(w, "{\"error\":"+err.Error()+"}")
+			JSONErrorFrom(w, r, err)
 		} else {
+			writeObjectHeaders(w, entry)
 			JSONResponseFromString(w, "{\"result\":"+res+"}")
 		}
 	}
 }
 
+// Head answers from the directory alone, without bothering the cell
+func Head(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	entry, err := getRequestedEntry(r, "default", vars["id"])
+	if err != nil {
+		status, _ := errorStatus(err)
+		w.WriteHeader(status)
+		return
+	}
+	writeObjectHeaders(w, entry)
+	w.WriteHeader(http.StatusOK)
+}
+
+// requestChecksumMatches checks the payload against the checksum the
+// client sent along, if it sent one
+func requestChecksumMatches(w http.ResponseWriter, r *http.Request, payload string) bool {
+	expected := r.Header.Get(checksumHeader)
+	if expected == "" || strings.EqualFold(expected, Checksum(payload)) {
+		return true
+	}
+	JSONError(w, r, http.StatusBadRequest, ErrCodeChecksumMismatch, "payload does not match "+checksumHeader)
+	return false
+}
+
 func Store(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	cellid, err := getDirectoryEntryCellId(&dbConnectionContext, "default", vars["id"])
+	ctx := r.Context()
+	if !requestChecksumMatches(w, r, vars["info"]) {
+		return
+	}
+	// If-None-Match: * asks for create-only semantics, which is also what
+	// we do for unversioned categories unless the caller asks to overwrite
+	createOnly := r.Header.Get("If-None-Match") == "*"
+	overwrite := r.URL.Query().Get("overwrite") == "true" && !createOnly
+	_, err := getDirectoryEntryCellId(ctx, &dbConnectionContext, "default", vars["id"])
+	if err == nil && createOnly {
+		slog.DebugContext(ctx, "already exists", "path", vars["id"])
+		JSONError(w, r, http.StatusConflict, ErrCodeConflict, "item exists")
+		return
+	}
+	if isVersioned(&dbConnectionContext, "default", vars["id"]) {
+		StoreVersion(w, r)
+		return
+	}
 	if err == nil {
-		fmt.Println("  Value " + vars["id"] + " already exists")
-		JSONResponseFromString(w, "{\"result\":\"'Item exists'\"}")
+		if !overwrite {
+			slog.DebugContext(ctx, "already exists", "path", vars["id"])
+			JSONError(w, r, http.StatusConflict, ErrCodeConflict, "item exists")
+			return
+		}
+		slog.DebugContext(ctx, "already exists, overwriting", "path", vars["id"])
+		Update(w, r)
 		return
 	}
-	fmt.Println("  # controller # Attempting to store value " + vars["id"])
-	lengthOfValue := int64(len(vars["info"]))
-	cellid = findCellWithFreeSpace(&dbConnectionContext, lengthOfValue)
-	if cellid == -1 {
-		JSONResponseFromString(w, "{\"result\":\"'Try later'\"}")
+	slog.DebugContext(ctx, "storing", "path", vars["id"])
+	entry, err := createObject(ctx, &dbConnectionContext, "default", vars["id"], vars["info"], objectMetaFromRequest(r, vars["info"]))
+	if err == errExists {
+		slog.DebugContext(ctx, "stored concurrently", "path", vars["id"])
+		JSONErrorFrom(w, r, err)
+	} else if err != nil {
+		JSONErrorFrom(w, r, err)
 	} else {
-		fmt.Println("Storing data in cell " + strconv.Itoa(cellid))
-		addDirErr := addDirectoryEntry(&dbConnectionContext, "default", vars["id"], lengthOfValue, cellid)
-		if addDirErr != nil {
-			JSONResponseFromString(w, "{\"result\":\"'Server error'\"}")
-		} else {
-			cellURL := makeCellURL(cellid)
-			_, err := http.Post(cellURL+"/"+vars["id"]+"/"+vars["info"], "application/text", nil)
-			if err != nil {
-				JSONResponseFromString(w, "{\"error\":"+err.Error()+"}")
-			} else {
-				addUsedStorage(&dbConnectionContext, lengthOfValue, cellid)
-				fmt.Println("serverstatus.UsedSpace updated")
-
-				//
-				// Check Scale Up condition @TODO make separate functions
-				//
-				if (serverstatus.TotalSpace - serverstatus.UsedSpace) < serverstatus.SUT {
-					if ServerState == SNAFU {
-						fmt.Println("Scale up condition found")
-						go ScaleUp(&dbConnectionContext)
-					} else {
-						fmt.Println("Scale up condition found, but still scaling or something")
-					}
-				} else {
-					fmt.Println("There is still " + strconv.Itoa(int(serverstatus.TotalSpace-serverstatus.UsedSpace)) + " bytes free")
-				}
+		CheckScaleUp(ctx, &dbConnectionContext)
+		w.Header().Set("ETag", "\""+entry.Checksum+"\"")
+		JSONResponseFromString(w, "{\"result\":\"'OK'\", \"bytes\":"+strconv.FormatInt(objectSize(entry.Size, entry.Envelope), 10)+"}")
+	}
+}
 
-				JSONResponseFromString(w, "{\"result\":\"'OK'\", \"bytes\":"+strconv.FormatInt(lengthOfValue, 10)+"}")
-			}
-		}
+func Update(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	ctx := r.Context()
+	slog.DebugContext(ctx, "updating", "path", vars["id"])
+	if !requestChecksumMatches(w, r, vars["info"]) {
+		return
+	}
+	if isVersioned(&dbConnectionContext, "default", vars["id"]) {
+		StoreVersion(w, r)
+		return
+	}
+	entry, err := updateObject(ctx, &dbConnectionContext, "default", vars["id"], vars["info"], objectMetaFromRequest(r, vars["info"]))
+	if err != nil {
+		JSONErrorFrom(w, r, err)
+		return
 	}
+	CheckScaleUp(ctx, &dbConnectionContext)
+	CheckScaleDown(ctx, &dbConnectionContext)
+	w.Header().Set("ETag", "\""+entry.Checksum+"\"")
+	JSONResponseFromString(w, "{\"result\":\"'OK'\", \"bytes\":"+strconv.FormatInt(objectSize(entry.Size, entry.Envelope), 10)+"}")
 }
 
 func Delete(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	fmt.Println("  # controller # Attempting to retrieve value " + vars["id"])
-	cellid, err := getDirectoryEntryCellId(&dbConnectionContext, "default", vars["id"])
-	if err != nil {
-		JSONResponseFromString(w, "{\"error\":"+err.Error()+"}")
+	ctx := r.Context()
+	slog.DebugContext(ctx, "deleting", "path", vars["id"])
+	var entry Directory
+	var err error
+	if version := r.URL.Query().Get("version"); version != "" {
+		number, parseErr := strconv.ParseInt(version, 10, 64)
+		if parseErr != nil {
+			JSONErrorFrom(w, r, errBadVersion)
+			return
+		}
+		entry, err = purgeVersion(ctx, &dbConnectionContext, "default", vars["id"], number)
+	} else if isVersioned(&dbConnectionContext, "default", vars["id"]) {
+		entry, err = deleteVersion(ctx, &dbConnectionContext, "default", vars["id"])
 	} else {
-		size, dbErr := removeDirectoryEntry(&dbConnectionContext, "default", vars["id"])
-		fmt.Println(" Size from DB: ")
-		fmt.Println(size)
-		if dbErr != nil {
-			// what do we do here?
-			fmt.Println("  >> Delete : dbErr = " + dbErr.Error())
-			size = 0
-		}
-		deleteErr := CellDelete("default", vars["id"], cellid)
-		if deleteErr != nil {
-			fmt.Println("  >> Delete : deleteErr = " + deleteErr.Error())
+		entry, err = deleteObject(ctx, &dbConnectionContext, "default", vars["id"])
+	}
+	if err != nil {
+		JSONErrorFrom(w, r, err)
+		return
+	}
+	slog.DebugContext(ctx, "deleted", "path", vars["id"], "size", entry.Size)
+	CheckScaleDown(ctx, &dbConnectionContext)
+
+	JSONResponseFromString(w, "{\"result\":\"success\"}")
+}
+
+func StoreVersion(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	ctx := r.Context()
+	slog.DebugContext(ctx, "storing a new version", "path", vars["id"])
+	entry, err := storeVersion(ctx, &dbConnectionContext, "default", vars["id"], vars["info"], objectMetaFromRequest(r, vars["info"]))
+	if err != nil {
+		JSONErrorFrom(w, r, err)
+		return
+	}
+	CheckScaleUp(ctx, &dbConnectionContext)
+	w.Header().Set("ETag", "\""+entry.Checksum+"\"")
+	JSONResponseFromString(w, "{\"result\":\"'OK'\", \"bytes\":"+strconv.FormatInt(objectSize(entry.Size, entry.Envelope), 10)+
+		", \"version\":"+strconv.FormatInt(entry.Version, 10)+"}")
+}
+
+func ListVersions(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	entries, err := getDirectoryVersions(&dbConnectionContext, "default", vars["id"])
+	if err != nil {
+		JSONErrorFrom(w, r, err)
+		return
+	}
+	if len(entries) == 0 {
+		JSONErrorFrom(w, r, mongo.ErrNoDocuments)
+		return
+	}
+	res, _ := json.Marshal(entries)
+	JSONResponseFromString(w, "{\"result\":"+string(res)+"}")
+}
+
+func GetCategorySettings(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	settings, err := getCategory(&dbConnectionContext, vars["category"])
+	if err != nil {
+		JSONErrorFrom(w, r, err)
+		return
+	}
+	res, _ := json.Marshal(settings)
+	JSONResponseFromString(w, "{\"result\":"+string(res)+"}")
+}
+
+// SetCategorySettings changes the settings given in the query and leaves
+// the others as they are
+func SetCategorySettings(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	query := r.URL.Query()
+	current, err := getCategory(&dbConnectionContext, vars["category"])
+	if err != nil {
+		JSONErrorFrom(w, r, err)
+		return
+	}
+	maxBytes, maxObjects := current.MaxBytes, current.MaxObjects
+	for name, limit := range map[string]*int64{"maxbytes": &maxBytes, "maxobjects": &maxObjects} {
+		if !query.Has(name) {
+			continue
+		}
+		*limit, err = strconv.ParseInt(query.Get(name), 10, 64)
+		if err != nil || *limit < 0 {
+			JSONError(w, r, http.StatusBadRequest, ErrCodeBadRequest, "bad "+name)
+			return
+		}
+	}
+	if query.Has("versioning") {
+		err = setCategoryVersioning(&dbConnectionContext, vars["category"], query.Get("versioning") == "true")
+		if err != nil {
+			JSONErrorFrom(w, r, err)
+			return
+		}
+	}
+	if maxBytes != current.MaxBytes || maxObjects != current.MaxObjects {
+		err = setCategoryQuota(&dbConnectionContext, vars["category"], maxBytes, maxObjects)
+		if err != nil {
+			JSONErrorFrom(w, r, err)
+			return
 		}
-		removeUsedStorage(&dbConnectionContext, size, cellid)
+	}
+	GetCategorySettings(w, r)
+}
 
-		//
-		// Check Scale Down condition @TODO make separate functions
-		//
-		if (serverstatus.TotalSpace - serverstatus.UsedSpace) > serverstatus.SDT {
-			if ServerState == SNAFU {
-				fmt.Println("Scale down condition found")
-				go Drain(&dbConnectionContext)
-			} else {
-				fmt.Println("Scale down condition found, but still doing some other shit")
-			}
-		} else {
-			fmt.Println("There is still just " + strconv.Itoa(int(serverstatus.TotalSpace-serverstatus.UsedSpace)) + " bytes free")
+func ReportCorruption(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	ctx := r.Context()
+	cellid, err := strconv.Atoi(vars["cellid"])
+	if err != nil {
+		JSONError(w, r, http.StatusBadRequest, ErrCodeBadRequest, "bad cell id")
+		return
+	}
+	repaired := r.URL.Query().Get("repaired") == "true"
+	slog.WarnContext(ctx, "cell reports corrupt object", "cell", cellid, "key", vars["key"], "repaired", repaired)
+	atomic.AddInt64(&corruptionsReported, 1)
+	go handleCorruption(ctx, &dbConnectionContext, vars["key"], cellid, repaired)
+	JSONResponseFromString(w, "{\"result\":\"accepted\"}")
+}
+
+func ListCorruptions(w http.ResponseWriter, r *http.Request) {
+	corruptions, err := getCorruptions(&dbConnectionContext)
+	if err != nil {
+		JSONErrorFrom(w, r, err)
+		return
+	}
+	res, _ := json.Marshal(corruptions)
+	JSONResponseFromString(w, "{\"result\":"+string(res)+"}")
+}
+
+const maxListLimit = 1000
+
+func ListObjects(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit := maxListLimit
+	if query.Get("limit") != "" {
+		number, err := strconv.Atoi(query.Get("limit"))
+		if err != nil || number < 1 {
+			JSONError(w, r, http.StatusBadRequest, ErrCodeBadRequest, "bad limit")
+			return
 		}
+		if number < maxListLimit {
+			limit = number
+		}
+	}
+	// continuation tokens are the last path or common prefix handed out
+	after, err := base64.RawURLEncoding.DecodeString(query.Get("continuation"))
+	if err != nil {
+		JSONError(w, r, http.StatusBadRequest, ErrCodeBadRequest, "bad continuation token")
+		return
+	}
+	listing, err := listObjects(&dbConnectionContext, "default", query.Get("prefix"), query.Get("delimiter"), string(after), limit)
+	if err != nil {
+		JSONErrorFrom(w, r, err)
+		return
+	}
+	res, _ := json.Marshal(listing)
+	JSONResponseFromString(w, "{\"result\":"+string(res)+"}")
+}
 
-		err = CellDelete("default", vars["key"], cellid)
-		if err != nil {
-			JSONResponseFromString(w, "{\"error\":"+err.Error()+"}")
-		} else {
-			JSONResponseFromString(w, "{\"result\":\"success\"}")
+func RunFsck(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	repair := r.URL.Query().Get("repair") == "true"
+	report, err := Fsck(ctx, &dbConnectionContext, repair)
+	if err != nil {
+		JSONErrorFrom(w, r, err)
+		return
+	}
+	res, _ := json.Marshal(report)
+	JSONResponseFromString(w, "{\"result\":"+string(res)+"}")
+}
+
+// ListCells answers with what the directory believes each cell holds, in
+// cell order
+func ListCells(w http.ResponseWriter, r *http.Request) {
+	statuses, err := getCellStatuses(&dbConnectionContext)
+	if err != nil {
+		JSONErrorFrom(w, r, err)
+		return
+	}
+	cells := []CellStatus{}
+	for cellid := 0; cellid < serverstatus.NumberOfCells; cellid++ {
+		if status, exists := statuses[cellid]; exists {
+			cells = append(cells, status)
 		}
 	}
+	res, _ := json.Marshal(cells)
+	JSONResponseFromString(w, "{\"result\":"+string(res)+"}")
+}
+
+func DrainCell(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	cellid, err := StartDrain(ctx, &dbConnectionContext)
+	if err != nil {
+		JSONErrorFrom(w, r, err)
+		return
+	}
+	JSONResponseFromString(w, "{\"result\":\"draining cell "+strconv.Itoa(cellid)+"\"}")
 }
 
-func GetServiceStatus(w http.ResponseWriter, r *http.Request) {
-	livingCells := detectLivingCells()
-	JSONResponseFromString(w, "{\"revision\":"+strconv.Itoa(revision)+", \"cells-alive\":"+strconv.Itoa(livingCells)+", "+
-		"\"numberofcells\":"+strconv.Itoa(serverstatus.NumberOfCells)+", "+
-		"\"totalspace\":"+strconv.Itoa(int(serverstatus.TotalSpace))+", "+
-		"\"usedspace\":"+strconv.Itoa(int(serverstatus.UsedSpace))+", "+
-		"\"suthreshold\":"+strconv.Itoa(int(serverstatus.SUT))+", "+
-		"\"sdthreshold\":"+strconv.Itoa(int(serverstatus.SDT))+"}")
+func RebalanceCells(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if ServerState != SNAFU {
+		JSONErrorFrom(w, r, errScaling)
+		return
+	}
+	if serverstatus.NumberOfCells < 2 {
+		JSONResponseFromString(w, "{\"result\":\"nothing to rebalance\"}")
+		return
+	}
+	rebalanceCtx := backgroundContext("rebalance")
+	slog.InfoContext(ctx, "rebalance requested", "operation", requestIdFrom(rebalanceCtx))
+	go Rebalance(rebalanceCtx, &dbConnectionContext)
+	JSONResponseFromString(w, "{\"result\":\"rebalancing\"}")
 }
 
 //////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
@@ -725,6 +2693,11 @@ func GetServiceStatus(w http.ResponseWriter, r *http.Request) {
 
 func main() {
 
+	setupLogging("controller")
+	if err := setupTracing("controller"); err != nil {
+		slog.Error("could not set up tracing", "error", err)
+	}
+
 	ControllerPort := "2222"
 
 	db_svr = os.Getenv("DB_SVR")
@@ -747,6 +2720,15 @@ func main() {
 	if cell_name_prefix == "" {
 		cell_name_prefix = "storagecells-sts"
 	}
+	cell_grpc_port = os.Getenv("CELL_GRPC_PORT")
+	if cell_grpc_port == "" {
+		cell_grpc_port = "7778"
+	}
+	cell_transport = os.Getenv("CELL_TRANSPORT")
+	if err := setupCellTLS(); err != nil {
+		slog.Error("could not load the cell TLS certificates", "error", err)
+		os.Exit(1)
+	}
 
 	StatefulSetName = os.Getenv("STSNAME")
 	if StatefulSetName == "" {
@@ -763,60 +2745,113 @@ func main() {
 		panic(err.Error())
 	}
 
-	fmt.Println("Trying to connecto to " + db_svr + ":" + db_port + "...")
+	slog.Info("connecting to MongoDB", "server", db_svr+":"+db_port)
 	client, err := connectToDB()
 	err = client.Ping(context.TODO(), nil)
 
 	if err != nil {
-		log.Fatal(err)
+		slog.Error("could not connect to MongoDB", "error", err)
+		os.Exit(1)
 	}
 
-	fmt.Println("Connected to MongoDB!")
+	slog.Info("connected to MongoDB")
 
 	dbConnectionContext.client = client
 	dbConnectionContext.serverstatus = client.Database("service").Collection("serverstatus")
 	dbConnectionContext.cellstatus = client.Database("service").Collection("cellstatus")
 	dbConnectionContext.directories = client.Database("service").Collection("directories")
+	dbConnectionContext.categories = client.Database("service").Collection("categories")
+	dbConnectionContext.corruptions = client.Database("service").Collection("corruptions")
+	dbConnectionContext.apikeys = client.Database("service").Collection("apikeys")
+	dbConnectionContext.multipartuploads = client.Database("service").Collection("multipartuploads")
+	dbConnectionContext.multipartparts = client.Database("service").Collection("multipartparts")
+	dbConnectionContext.transactions = detectTransactionSupport(&dbConnectionContext)
+	slog.Info("transactions", "supported", dbConnectionContext.transactions)
+	acquireLease(&dbConnectionContext)
+	if err := ensureDirectoryIndexes(&dbConnectionContext); err != nil {
+		slog.Warn("could not create directory indexes, duplicate entries may exist", "error", err)
+	}
 
-	fmt.Println("Trying to recover status from db...")
 	status, staterr := getServerStatus(&dbConnectionContext)
 	serverstatus = status
-	if staterr != nil {
-		fmt.Println(" The error trying to recover status from db was: " + staterr.Error())
-	} else {
-		fmt.Println(" The error trying to recover status from db was: none")
-		fmt.Println(serverstatus)
-	}
 
 	if staterr != nil {
-		fmt.Println("  ... none found, initializing")
+		slog.Info("no server status saved, initializing", "error", staterr)
 		_ = initializeServerStatus(&dbConnectionContext)
 		//status, _ = getServerStatus(&dbConnectionContext)
-		fmt.Println("       get from db after initialization: ")
-		fmt.Println(serverstatus)
 		//serverstatus = status
 	}
 
-	fmt.Println("Number of cells: " + strconv.Itoa(serverstatus.NumberOfCells))
+	slog.Info("server status", "cells", serverstatus.NumberOfCells, "totalspace", serverstatus.TotalSpace,
+		"usedspace", serverstatus.UsedSpace, "suthreshold", serverstatus.SUT, "sdthreshold", serverstatus.SDT)
+
+	setupAdmission()
+	if err := clearReservations(&dbConnectionContext); err != nil {
+		slog.Warn("could not clear reservations left from before, the cells may look fuller than they are", "error", err)
+	}
+	setupAuth(&dbConnectionContext)
+	if err := setupEncryption(); err != nil {
+		slog.Error("could not load the master keys", "error", err)
+		os.Exit(1)
+	}
+
+	healthInterval, err := strconv.Atoi(os.Getenv("HEALTH_INTERVAL"))
+	if err != nil || healthInterval <= 0 {
+		healthInterval = 10
+	}
+	go HealthChecker(time.Duration(healthInterval) * time.Second)
+
+	fsckInterval, _ := strconv.Atoi(os.Getenv("FSCK_INTERVAL"))
+	if fsckInterval > 0 {
+		go PeriodicFsck(&dbConnectionContext, time.Duration(fsckInterval)*time.Second, os.Getenv("FSCK_REPAIR") == "true")
+	}
+
+	s3Port := os.Getenv("S3_PORT")
+	if s3Port == "" {
+		s3Port = "9000"
+	}
+	go StartS3Gateway(s3Port)
 
 	r := mux.NewRouter()
+	r.Use(traceRequests("rest"))
+	r.Use(logRequests)
+	r.Use(instrumentRoutes("rest"))
+	r.Use(authenticate)
+	r.Use(preferWait)
 	r.HandleFunc("/healthcheck", HealthCheck).Methods("GET")
 	r.HandleFunc("/status", GetServiceStatus).Methods("GET")
+	r.HandleFunc("/openapi.json", OpenAPISpec).Methods("GET")
+	r.Handle("/metrics", promhttp.Handler()).Methods("GET")
+	r.HandleFunc("/admin/fsck", RunFsck).Methods("POST")
+	r.HandleFunc("/admin/cells", ListCells).Methods("GET")
+	r.HandleFunc("/admin/drain", DrainCell).Methods("POST")
+	r.HandleFunc("/admin/rebalance", RebalanceCells).Methods("POST")
+	r.HandleFunc("/admin/corruption", ListCorruptions).Methods("GET")
+	r.HandleFunc("/admin/corruption/{cellid}/{key}", ReportCorruption).Methods("POST")
+	r.HandleFunc("/admin/categories/{category}", GetCategorySettings).Methods("GET")
+	r.HandleFunc("/admin/categories/{category}", SetCategorySettings).Methods("PUT")
+	r.HandleFunc("/admin/usage", GetUsage).Methods("GET")
+	r.HandleFunc("/admin/keys", IssueKey).Methods("POST")
+	r.HandleFunc("/admin/keys", ListKeys).Methods("GET")
+	r.HandleFunc("/admin/keys/{id}", RevokeKey).Methods("DELETE")
+	r.HandleFunc("/versions/{id}", ListVersions).Methods("GET")
+	r.HandleFunc("/objects", ListObjects).Methods("GET")
 
 	r.HandleFunc("/post/{id}/{info}", Store).Methods("GET")
 	r.HandleFunc("/get/{id}/{info}", Retrieve).Methods("GET")
+	r.HandleFunc("/update/{id}/{info}", Update).Methods("GET")
 	r.HandleFunc("/delete/{id}/{info}", Delete).Methods("GET")
 
 	r.HandleFunc("/{id}/{info}", Store).Methods("POST")
-	//r.HandleFunc("/{id}/{info}", Update).Methods("PUT")
+	r.HandleFunc("/{id}/{info}", Update).Methods("PUT")
 	r.HandleFunc("/{id}/{info}", Retrieve).Methods("GET")
+	r.HandleFunc("/{id}/{info}", Head).Methods("HEAD")
 	r.HandleFunc("/{id}/{info}", Delete).Methods("DELETE")
 
-	fmt.Println(" and again: ")
-	fmt.Println(serverstatus)
-
+	slog.Info("controller started", "port", ControllerPort)
 	if err := http.ListenAndServe(":"+ControllerPort, r); err != nil {
-		log.Fatal(err)
+		slog.Error("controller stopped", "error", err)
+		os.Exit(1)
 	}
 
 }
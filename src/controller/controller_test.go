@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// listAll pages through paths the way listObjects does against the
+// directory, which hands out the paths under prefix after the continuation
+func listAll(t *testing.T, paths []string, prefix string, delimiter string, limit int) []ObjectListing {
+	sort.Strings(paths)
+	var pages []ObjectListing
+	after := ""
+	for len(pages) < len(paths)+1 {
+		page := newListingPage(prefix, delimiter, after, limit)
+		for _, path := range paths {
+			if strings.HasPrefix(path, prefix) && path > after && !page.add(ObjectInfo{Path: path}) {
+				break
+			}
+		}
+		pages = append(pages, page.listing)
+		if !page.listing.Truncated {
+			return pages
+		}
+		decoded, err := base64.RawURLEncoding.DecodeString(page.listing.Continuation)
+		if err != nil {
+			t.Fatalf("bad continuation token %q: %v", page.listing.Continuation, err)
+		}
+		after = string(decoded)
+	}
+	t.Fatalf("listing does not end")
+	return nil
+}
+
+// pageSummary is a page as objects, with common prefixes in brackets
+func pageSummary(listing ObjectListing) []string {
+	summary := []string{}
+	for _, commonPrefix := range listing.CommonPrefixes {
+		summary = append(summary, "["+commonPrefix+"]")
+	}
+	for _, object := range listing.Objects {
+		summary = append(summary, object.Path)
+	}
+	return summary
+}
+
+func TestListObjectsPaging(t *testing.T) {
+	paths := []string{"a/1", "a/2", "a/3", "b", "c/1", "c/x/2", "d"}
+	tests := []struct {
+		name      string
+		prefix    string
+		delimiter string
+		limit     int
+		want      [][]string
+	}{
+		{"flat", "", "", 3, [][]string{{"a/1", "a/2", "a/3"}, {"b", "c/1", "c/x/2"}, {"d"}}},
+		{"page per common prefix", "", "/", 1, [][]string{{"[a/]"}, {"b"}, {"[c/]"}, {"d"}}},
+		{"page ending on a common prefix", "", "/", 2, [][]string{{"[a/]", "b"}, {"[c/]", "d"}}},
+		{"flat page ending inside a directory", "", "", 2, [][]string{{"a/1", "a/2"}, {"a/3", "b"}, {"c/1", "c/x/2"}, {"d"}}},
+		{"under a prefix", "c/", "/", 1, [][]string{{"c/1"}, {"[c/x/]"}}},
+		{"exact fit", "", "/", 4, [][]string{{"[a/]", "[c/]", "b", "d"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got [][]string
+			for _, page := range listAll(t, paths, test.prefix, test.delimiter, test.limit) {
+				got = append(got, pageSummary(page))
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got pages %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestListObjectsBadContinuation(t *testing.T) {
+	w := httptest.NewRecorder()
+	ListObjects(w, httptest.NewRequest("GET", "/objects?continuation=not+base64!", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if !strings.Contains(w.Body.String(), ErrCodeBadRequest) {
+		t.Errorf("got body %s, want a %s error", w.Body.String(), ErrCodeBadRequest)
+	}
+}
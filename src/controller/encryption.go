@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+//																														//
+// Encryption																											//
+//																														//
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+// With a master key configured, objects are encrypted before they go to a
+// cell, so the cells' volumes only ever hold ciphertext. Every object gets
+// a data key of its own, which encrypts the payload with AES-256-GCM; the
+// data key is wrapped, encrypted, with the master key and kept in the
+// object's directory entry, which never goes near a cell. The payload is
+// bound to the object's cell key, so a value copied under another key does
+// not decrypt. The cell holds nonce and ciphertext base64url encoded, as
+// the payload has to fit in a path segment: Size in the directory is what
+// the cell holds, objectSize what the client sent.
+//
+// ENCRYPTION_KEY_FILE has the master keys, base64, one per line: the first
+// encrypts, all of them decrypt, so a key can be rotated by putting the new
+// one first and keeping the old one until everything written with it is
+// gone. ENCRYPTION_KEY holds a single key instead. Without either, objects
+// are stored as they come; objects stored before are read either way.
+
+const dataKeySize = 32
+
+// encryptedOverhead is what GCM adds to a payload, before encoding
+const encryptedOverhead = 12 + 16
+
+// Envelope is how an encrypted object's data key is kept
+type Envelope struct {
+	MasterKey  string `bson:"masterkey"`
+	WrappedKey string `bson:"wrappedkey"`
+}
+
+type masterKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// masterKeys[0] encrypts; none means encryption is off
+var masterKeys []masterKey
+
+var errNoMasterKey = errors.New("the master key the object was encrypted with is not loaded")
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// masterKeyId tells the master keys apart without giving anything away
+func masterKeyId(key []byte) string {
+	sum := sha256.Sum256(append([]byte("eks master key "), key...))
+	return hex.EncodeToString(sum[:8])
+}
+
+func setupEncryption() error {
+	var lines []string
+	if name := os.Getenv("ENCRYPTION_KEY_FILE"); name != "" {
+		content, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		lines = strings.Split(string(content), "\n")
+	} else if key := os.Getenv("ENCRYPTION_KEY"); key != "" {
+		lines = []string{key}
+	}
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(line)
+		if err != nil || len(key) != 32 {
+			return errors.New("master keys must be 32 bytes, base64 encoded")
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return err
+		}
+		masterKeys = append(masterKeys, masterKey{masterKeyId(key), aead})
+	}
+	if len(masterKeys) == 0 {
+		slog.Info("no master key, objects are stored unencrypted")
+		return nil
+	}
+	slog.Info("encrypting objects", "masterkey", masterKeys[0].id, "masterkeys", len(masterKeys))
+	return nil
+}
+
+func sealWith(aead cipher.AEAD, plaintext []byte, additionalData []byte) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+	return aead.Seal(nonce, nonce, plaintext, additionalData)
+}
+
+func openWith(aead cipher.AEAD, sealed []byte, additionalData []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], additionalData)
+}
+
+// sealPayload encrypts the payload of the object with cell key key under a
+// new data key, if encryption is on. It returns what goes to the cell, and
+// the envelope for the directory entry, nil when the payload goes as is.
+func sealPayload(key string, payload string) (string, *Envelope, error) {
+	if len(masterKeys) == 0 {
+		return payload, nil, nil
+	}
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return "", nil, err
+	}
+	sealed := sealWith(aead, []byte(payload), []byte(key))
+	wrapped := sealWith(masterKeys[0].aead, dataKey, []byte(key))
+	return base64.RawURLEncoding.EncodeToString(sealed),
+		&Envelope{MasterKey: masterKeys[0].id, WrappedKey: base64.StdEncoding.EncodeToString(wrapped)}, nil
+}
+
+// openPayload undoes sealPayload on what the cell holds for key
+func openPayload(key string, stored string, envelope *Envelope) (string, error) {
+	if envelope == nil {
+		return stored, nil
+	}
+	var master *masterKey
+	for i := range masterKeys {
+		if masterKeys[i].id == envelope.MasterKey {
+			master = &masterKeys[i]
+		}
+	}
+	if master == nil {
+		return "", errNoMasterKey
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(envelope.WrappedKey)
+	if err != nil {
+		return "", err
+	}
+	dataKey, err := openWith(master.aead, wrapped, []byte(key))
+	if err != nil {
+		return "", errors.New("could not unwrap the data key of " + key + ": " + err.Error())
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(stored)
+	if err != nil {
+		return "", err
+	}
+	payload, err := openWith(aead, sealed, []byte(key))
+	if err != nil {
+		return "", errors.New("could not decrypt " + key + ": " + err.Error())
+	}
+	return string(payload), nil
+}
+
+// objectSize is the size of the payload as the client sent it, for an
+// object taking size bytes on its cell
+func objectSize(size int64, envelope *Envelope) int64 {
+	if envelope == nil {
+		return size
+	}
+	return int64(base64.RawURLEncoding.DecodedLen(int(size))) - encryptedOverhead
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newMasterKey(t *testing.T) string {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// useMasterKeys sets encryption up with keys, as ENCRYPTION_KEY_FILE would
+// have them
+func useMasterKeys(t *testing.T, keys ...string) {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(name, []byte("# master keys\n"+strings.Join(keys, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("ENCRYPTION_KEY_FILE", name)
+	masterKeys = nil
+	t.Cleanup(func() { masterKeys = nil })
+	if err := setupEncryption(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSealRoundTrip(t *testing.T) {
+	useMasterKeys(t, newMasterKey(t))
+	for _, payload := range []string{"", "hello", strings.Repeat("x", 100000)} {
+		stored, envelope, err := sealPayload("greeting", payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if envelope == nil || envelope.MasterKey != masterKeys[0].id {
+			t.Fatalf("got envelope %+v, want one for master key %s", envelope, masterKeys[0].id)
+		}
+		if payload != "" && strings.Contains(stored, payload) {
+			t.Errorf("the cell would get the payload in the clear")
+		}
+		if strings.ContainsAny(stored, "/+=") {
+			t.Errorf("stored value %q does not fit in a path segment", stored)
+		}
+		if size := objectSize(int64(len(stored)), envelope); size != int64(len(payload)) {
+			t.Errorf("got object size %d, want %d", size, len(payload))
+		}
+		opened, err := openPayload("greeting", stored, envelope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opened != payload {
+			t.Errorf("got %q back, want %q", opened, payload)
+		}
+	}
+}
+
+func TestSealNoMasterKey(t *testing.T) {
+	useMasterKeys(t)
+	stored, envelope, err := sealPayload("greeting", "hello")
+	if err != nil || envelope != nil || stored != "hello" {
+		t.Fatalf("got %q, %+v, %v; want the payload as is", stored, envelope, err)
+	}
+	if opened, err := openPayload("greeting", stored, nil); err != nil || opened != "hello" {
+		t.Errorf("got %q, %v; want the payload as is", opened, err)
+	}
+}
+
+func TestOpenWrongKey(t *testing.T) {
+	useMasterKeys(t, newMasterKey(t))
+	stored, envelope, err := sealPayload("greeting", "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("other cell key", func(t *testing.T) {
+		if _, err := openPayload("farewell", stored, envelope); err == nil {
+			t.Errorf("a value copied under another key decrypted")
+		}
+	})
+	t.Run("tampered ciphertext", func(t *testing.T) {
+		sealed, _ := base64.RawURLEncoding.DecodeString(stored)
+		sealed[len(sealed)-1] ^= 1
+		if _, err := openPayload("greeting", base64.RawURLEncoding.EncodeToString(sealed), envelope); err == nil {
+			t.Errorf("a tampered value decrypted")
+		}
+	})
+	t.Run("other object's data key", func(t *testing.T) {
+		_, other, err := sealPayload("greeting", "hello")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := openPayload("greeting", stored, other); err == nil {
+			t.Errorf("a value decrypted with another object's data key")
+		}
+	})
+	t.Run("other master key", func(t *testing.T) {
+		useMasterKeys(t, newMasterKey(t))
+		if _, err := openPayload("greeting", stored, envelope); err != errNoMasterKey {
+			t.Errorf("got %v, want %v", err, errNoMasterKey)
+		}
+	})
+}
+
+func TestMasterKeyRotation(t *testing.T) {
+	oldKey, newKey := newMasterKey(t), newMasterKey(t)
+	useMasterKeys(t, oldKey)
+	oldStored, oldEnvelope, err := sealPayload("greeting", "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the new key goes first, the old one stays until nothing uses it
+	useMasterKeys(t, newKey, oldKey)
+	newStored, newEnvelope, err := sealPayload("greeting", "hola")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newEnvelope.MasterKey == oldEnvelope.MasterKey {
+		t.Fatalf("still sealing with the old master key")
+	}
+	if opened, err := openPayload("greeting", oldStored, oldEnvelope); err != nil || opened != "hello" {
+		t.Errorf("old object: got %q, %v; want %q", opened, err, "hello")
+	}
+	if opened, err := openPayload("greeting", newStored, newEnvelope); err != nil || opened != "hola" {
+		t.Errorf("new object: got %q, %v; want %q", opened, err, "hola")
+	}
+
+	useMasterKeys(t, newKey)
+	if _, err := openPayload("greeting", oldStored, oldEnvelope); err != errNoMasterKey {
+		t.Errorf("old object after the old key is gone: got %v, want %v", err, errNoMasterKey)
+	}
+	if opened, err := openPayload("greeting", newStored, newEnvelope); err != nil || opened != "hola" {
+		t.Errorf("new object after the old key is gone: got %q, %v; want %q", opened, err, "hola")
+	}
+}
+
+func TestSetupEncryptionBadKey(t *testing.T) {
+	t.Setenv("ENCRYPTION_KEY_FILE", "")
+	t.Setenv("ENCRYPTION_KEY", base64.StdEncoding.EncodeToString([]byte("too short")))
+	masterKeys = nil
+	t.Cleanup(func() { masterKeys = nil })
+	if err := setupEncryption(); err == nil {
+		t.Errorf("a 9 byte master key was taken")
+	}
+}
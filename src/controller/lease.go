@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+//																														//
+// Controller lease																										//
+//																														//
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+// Only one controller may run against a database at a time. Reservations
+// are given back wholesale when it starts, and drains, rebalances and fsck
+// are kept apart by locks it holds in memory, none of which would hold with
+// a second one. A controller therefore takes a lease, the "controller"
+// document of serverstatus, before it touches anything, and renews it for
+// as long as it runs. Another controller waits for the lease to expire
+// before it starts; one that cannot renew its lease in time exits rather
+// than run alongside whoever takes it next. The lease is held under the
+// host name, which a restarted container of the same pod keeps, so that it
+// can take the lease back straight away.
+
+const (
+	leaseID       = "controller"
+	leaseDuration = 30 * time.Second
+)
+
+var leaseHolder string
+
+func init() {
+	leaseHolder, _ = os.Hostname()
+	if leaseHolder == "" {
+		leaseHolder = "pid-" + strconv.Itoa(os.Getpid())
+	}
+}
+
+// takeLease takes or renews the lease, and reports whether it is ours. It
+// is ours if we held it already or it has expired; the upsert of a lease
+// somebody else holds fails on the _id
+func takeLease(ctx context.Context, conn *DBConnectionContext) (bool, error) {
+	now := time.Now()
+	_, err := conn.serverstatus.UpdateOne(ctx,
+		bson.D{{"_id", leaseID}, {"$or", bson.A{
+			bson.D{{"holder", leaseHolder}}, bson.D{{"expires", bson.D{{"$lt", now}}}}}}},
+		bson.D{{"$set", bson.D{{"holder", leaseHolder}, {"expires", now.Add(leaseDuration)}}}},
+		options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// acquireLease waits until the lease is ours, then keeps renewing it
+func acquireLease(conn *DBConnectionContext) {
+	for {
+		held, err := takeLease(context.TODO(), conn)
+		if held {
+			break
+		}
+		if err != nil {
+			slog.Warn("could not take the controller lease", "error", err)
+		} else {
+			slog.Info("another controller holds the lease, waiting for it to expire")
+		}
+		time.Sleep(leaseDuration / 3)
+	}
+	slog.Info("took the controller lease", "holder", leaseHolder)
+	go renewLease(conn)
+}
+
+func renewLease(conn *DBConnectionContext) {
+	renewed := time.Now()
+	for {
+		time.Sleep(leaseDuration / 3)
+		held, err := takeLease(context.TODO(), conn)
+		if held {
+			renewed = time.Now()
+			continue
+		}
+		if err == nil {
+			slog.Error("the controller lease was taken by another controller, exiting")
+			os.Exit(1)
+		}
+		slog.Warn("could not renew the controller lease", "error", err)
+		if time.Since(renewed) >= leaseDuration {
+			slog.Error("the controller lease expired, exiting")
+			os.Exit(1)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+//																														//
+// Logging																												//
+//																														//
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+// Everything logs through slog, as JSON on stdout unless LOG_FORMAT=text.
+// LOG_LEVEL picks the least severe level written: debug, info (the
+// default), warn or error.
+//
+// Every request gets an id, the caller's X-Request-Id if it sent one. It
+// rides in the request's context, down to the cells in the same header (or
+// gRPC metadata), and the handler set up here adds it to every line logged
+// with that context. Background work like drains gets an id of its own.
+
+const requestIdHeader = "X-Request-Id"
+
+// requestIdMetadata is the gRPC metadata key the id travels in
+const requestIdMetadata = "x-request-id"
+
+type contextKey int
+
+const requestIdKey contextKey = 0
+
+func newRequestId() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+func withRequestId(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIdKey, id)
+}
+
+func requestIdFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIdKey).(string)
+	return id
+}
+
+// backgroundContext is for work nobody asked for over HTTP; its log lines
+// can be told apart by the name of the operation in the id
+func backgroundContext(operation string) context.Context {
+	return withRequestId(context.Background(), operation+"-"+newRequestId())
+}
+
+// requestIdHandler adds the request id, if the context has one, to every
+// record, and the trace id when the request is being traced
+type requestIdHandler struct {
+	slog.Handler
+}
+
+func (h requestIdHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := requestIdFrom(ctx); id != "" {
+		record.AddAttrs(slog.String("requestid", id))
+	}
+	if span := trace.SpanContextFromContext(ctx); span.IsSampled() {
+		record.AddAttrs(slog.String("traceid", span.TraceID().String()))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h requestIdHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIdHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIdHandler) WithGroup(name string) slog.Handler {
+	return requestIdHandler{h.Handler.WithGroup(name)}
+}
+
+func setupLogging(service string) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(os.Getenv("LOG_LEVEL"))); err != nil {
+		level = slog.LevelInfo
+	}
+	options := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	if strings.ToLower(os.Getenv("LOG_FORMAT")) == "text" {
+		handler = slog.NewTextHandler(os.Stdout, options)
+	} else {
+		handler = slog.NewJSONHandler(os.Stdout, options)
+	}
+	slog.SetDefault(slog.New(requestIdHandler{handler}).With("service", service))
+}
+
+// probes and scrapes come every few seconds and say nothing interesting
+var quietRoutes = map[string]bool{"/healthcheck": true, "/metrics": true}
+
+// logRequests is mux middleware giving each request its id and logging it
+// once answered. It goes first, so that everything after it can log with
+// r.Context().
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIdHeader)
+		if id == "" {
+			id = newRequestId()
+		}
+		w.Header().Set(requestIdHeader, id)
+		trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("eks.request_id", id))
+		r = r.WithContext(withRequestId(r.Context(), id))
+		route := ""
+		if current := mux.CurrentRoute(r); current != nil {
+			route, _ = current.GetPathTemplate()
+		}
+		start := time.Now()
+		recorder := &statusRecorder{w, http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		level := slog.LevelInfo
+		if recorder.status >= 500 {
+			level = slog.LevelWarn
+		} else if quietRoutes[route] {
+			level = slog.LevelDebug
+		}
+		// not the path: on the REST API that has the payload in it
+		attrs := []any{"method", r.Method, "route", route, "status", recorder.status, "duration", time.Since(start)}
+		vars := mux.Vars(r)
+		if id, exists := vars["id"]; exists {
+			attrs = append(attrs, "id", id)
+		} else if key, exists := vars["key"]; exists {
+			attrs = append(attrs, "bucket", vars["bucket"], "key", key)
+		}
+		slog.Log(r.Context(), level, "request", attrs...)
+	})
+}
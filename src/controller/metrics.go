@@ -0,0 +1,190 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+//																														//
+// Metrics																												//
+//																														//
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+// Served on /metrics for Prometheus. Everything is prefixed eks_controller_;
+// the cells export their own under eks_cell_.
+
+var httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "eks_controller_http_requests_total",
+	Help: "HTTP requests answered, by API, route and status code.",
+}, []string{"api", "route", "method", "code"})
+
+var httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "eks_controller_http_request_duration_seconds",
+	Help:    "Time taken to answer HTTP requests, by API and route.",
+	Buckets: prometheus.ExponentialBuckets(0.001, 2, 16),
+}, []string{"api", "route", "method"})
+
+var storeRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "eks_controller_store_rejections_total",
+	Help: "Writes turned away because no cell had room for them, by operation.",
+}, []string{"operation"})
+
+var quotaRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "eks_controller_quota_rejections_total",
+	Help: "Writes refused because they would take a category over its quota, by category.",
+}, []string{"category"})
+
+var scaleEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "eks_controller_scale_events_total",
+	Help: "Scale ups and downs of the cell stateful set, by direction and result.",
+}, []string{"direction", "result"})
+
+var drainDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+	Name:    "eks_controller_drain_duration_seconds",
+	Help:    "Time taken to drain a cell, whether or not the drain finished.",
+	Buckets: prometheus.ExponentialBuckets(1, 2, 14),
+})
+
+var objectsMoved = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "eks_controller_objects_moved_total",
+	Help: "Objects moved from one cell to another, by reason.",
+}, []string{"reason"})
+
+func init() {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "eks_controller_state",
+		Help: "What the controller is doing: 0 nothing, 1 scaling up, 2 draining, 3 scaling down, 4 rebalancing.",
+	}, func() float64 { return float64(ServerState) })
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "eks_controller_cells",
+		Help: "Number of cells in the stateful set.",
+	}, func() float64 { return float64(serverstatus.NumberOfCells) })
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "eks_controller_total_bytes",
+		Help: "Capacity of all the cells together.",
+	}, func() float64 { return float64(serverstatus.TotalSpace) })
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "eks_controller_used_bytes",
+		Help: "Bytes stored over all the cells.",
+	}, func() float64 { return float64(serverstatus.UsedSpace) })
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "eks_controller_open_circuits",
+		Help: "Cells the controller has stopped calling after repeated failures.",
+	}, func() float64 { return float64(len(openCircuits())) })
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "eks_controller_checksum_mismatches_total",
+		Help: "Values that did not match their checksum when read back from a cell.",
+	}, func() float64 { return float64(atomic.LoadInt64(&checksumMismatches)) })
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "eks_controller_corruptions_reported_total",
+		Help: "Corrupt values reported by the cells' scrubbers.",
+	}, func() float64 { return float64(atomic.LoadInt64(&corruptionsReported)) })
+	prometheus.MustRegister(cellStatusCollector{})
+	prometheus.MustRegister(categoryCollector{})
+}
+
+// cellStatusCollector reads the cellstatus collection on every scrape, so
+// the numbers are the same ones the controller places objects by
+
+type cellStatusCollector struct{}
+
+var cellCapacityDesc = prometheus.NewDesc("eks_controller_cell_capacity_bytes",
+	"Capacity of each cell, as recorded in cellstatus.", []string{"cell"}, nil)
+var cellFreeDesc = prometheus.NewDesc("eks_controller_cell_free_bytes",
+	"Free space of each cell, as recorded in cellstatus.", []string{"cell"}, nil)
+var cellFilesDesc = prometheus.NewDesc("eks_controller_cell_objects",
+	"Objects held by each cell, as recorded in cellstatus.", []string{"cell"}, nil)
+
+func (c cellStatusCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- cellCapacityDesc
+	ch <- cellFreeDesc
+	ch <- cellFilesDesc
+}
+
+func (c cellStatusCollector) Collect(ch chan<- prometheus.Metric) {
+	if dbConnectionContext.cellstatus == nil {
+		return
+	}
+	statuses, err := getCellStatuses(&dbConnectionContext)
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(cellFreeDesc, err)
+		return
+	}
+	for cellid, status := range statuses {
+		cell := strconv.Itoa(cellid)
+		ch <- prometheus.MustNewConstMetric(cellCapacityDesc, prometheus.GaugeValue, float64(status.Capacity), cell)
+		ch <- prometheus.MustNewConstMetric(cellFreeDesc, prometheus.GaugeValue, float64(status.FreeSpace), cell)
+		ch <- prometheus.MustNewConstMetric(cellFilesDesc, prometheus.GaugeValue, float64(status.NumberOfFiles), cell)
+	}
+}
+
+// categoryCollector reports the usage counts the quotas are checked against
+type categoryCollector struct{}
+
+var categoryUsedDesc = prometheus.NewDesc("eks_controller_category_used_bytes",
+	"Bytes stored in each category, every version counted.", []string{"category"}, nil)
+var categoryObjectsDesc = prometheus.NewDesc("eks_controller_category_objects",
+	"Objects stored in each category, every version counted.", []string{"category"}, nil)
+var categoryQuotaDesc = prometheus.NewDesc("eks_controller_category_quota_bytes",
+	"Byte quota of each category that has one.", []string{"category"}, nil)
+
+func (c categoryCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- categoryUsedDesc
+	ch <- categoryObjectsDesc
+	ch <- categoryQuotaDesc
+}
+
+func (c categoryCollector) Collect(ch chan<- prometheus.Metric) {
+	if dbConnectionContext.categories == nil {
+		return
+	}
+	usage, err := getUsage(&dbConnectionContext)
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(categoryUsedDesc, err)
+		return
+	}
+	for _, category := range usage {
+		ch <- prometheus.MustNewConstMetric(categoryUsedDesc, prometheus.GaugeValue, float64(category.UsedBytes), category.Category)
+		ch <- prometheus.MustNewConstMetric(categoryObjectsDesc, prometheus.GaugeValue, float64(category.Objects), category.Category)
+		if category.MaxBytes > 0 {
+			ch <- prometheus.MustNewConstMetric(categoryQuotaDesc, prometheus.GaugeValue, float64(category.MaxBytes), category.Category)
+		}
+	}
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// instrumentRoutes is mux middleware counting and timing requests. Routes
+// are labelled by their template, so every object lands under /{id}/{info}.
+func instrumentRoutes(api string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			route := "unknown"
+			if current := mux.CurrentRoute(r); current != nil {
+				if template, err := current.GetPathTemplate(); err == nil {
+					route = template
+				}
+			}
+			start := time.Now()
+			recorder := &statusRecorder{w, http.StatusOK}
+			next.ServeHTTP(recorder, r)
+			httpDuration.WithLabelValues(api, route, r.Method).Observe(time.Since(start).Seconds())
+			httpRequests.WithLabelValues(api, route, r.Method, strconv.Itoa(recorder.status)).Inc()
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+//																														//
+// Quotas																												//
+//																														//
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+// Every category counts the bytes and objects stored in it, in its document
+// in the categories collection, kept in step with the directory by the
+// commit functions. A category can be given a quota in bytes, in objects or
+// both (PUT /admin/categories/{category}?maxbytes=&maxobjects=); stores
+// that would go over it are refused with quota_exceeded. Room under the
+// quota is reserved the same way room on a cell is: with an $inc that only
+// matches while there is room, given back once the store is committed, and
+// counted in reservedbytes and reservedobjects as well so that fsck leaves
+// it alone.
+// /admin/usage reports the counts for chargeback.
+
+const ErrCodeQuotaExceeded = "quota_exceeded"
+
+// quotaError refuses a store that would take a category over its quota
+type quotaError struct {
+	category string
+	limit    string
+}
+
+func (e *quotaError) Error() string {
+	return "category " + e.category + " would go over its quota of " + e.limit
+}
+
+// reserveQuota holds amount bytes and objects more under the category's
+// quota, until release is called once the store is committed or has
+// failed. Categories without a quota cost no extra round trip.
+func reserveQuota(ctx context.Context, conn *DBConnectionContext, category string, amount int64, objects int64) (func(), error) {
+	settings, err := getCategory(conn, category)
+	if err != nil {
+		return func() {}, err
+	}
+	var limits bson.A
+	if settings.MaxBytes > 0 && amount > 0 {
+		limits = append(limits, bson.D{{"$lte", bson.A{bson.D{{"$add", bson.A{"$usedbytes", amount}}}, settings.MaxBytes}}})
+	}
+	if settings.MaxObjects > 0 && objects > 0 {
+		limits = append(limits, bson.D{{"$lte", bson.A{bson.D{{"$add", bson.A{"$objects", objects}}}, settings.MaxObjects}}})
+	}
+	if len(limits) == 0 {
+		return func() {}, nil
+	}
+	res, err := conn.categories.UpdateOne(ctx, bson.D{{"_id", category}, {"$expr", bson.D{{"$and", limits}}}},
+		bson.D{{"$inc", bson.D{{"usedbytes", amount}, {"objects", objects},
+			{"reservedbytes", amount}, {"reservedobjects", objects}}}})
+	if err != nil {
+		return func() {}, err
+	}
+	if res.MatchedCount == 0 {
+		quotaRejections.WithLabelValues(category).Inc()
+		limit := strconv.FormatInt(settings.MaxObjects, 10) + " objects"
+		if settings.MaxBytes > 0 && amount > 0 && settings.UsedBytes+amount > settings.MaxBytes {
+			limit = strconv.FormatInt(settings.MaxBytes, 10) + " bytes"
+		}
+		return func() {}, &quotaError{category, limit}
+	}
+
+	ctx = context.WithoutCancel(ctx)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			_, err := conn.categories.UpdateOne(ctx, bson.D{{"_id", category}}, bson.D{{"$inc", bson.D{
+				{"usedbytes", -amount}, {"objects", -objects}, {"reservedbytes", -amount}, {"reservedobjects", -objects}}}})
+			if err != nil {
+				// it stays reserved until the controller restarts
+				slog.ErrorContext(ctx, "could not release reserved quota", "category", category, "error", err)
+			}
+		})
+	}, nil
+}
+
+// CategoryUsage is one line of the usage report, in category order
+type CategoryUsage struct {
+	Category   string `json:"category"`
+	UsedBytes  int64  `json:"usedbytes"`
+	Objects    int64  `json:"objects"`
+	MaxBytes   int64  `json:"maxbytes"`
+	MaxObjects int64  `json:"maxobjects"`
+}
+
+func getUsage(conn *DBConnectionContext) ([]CategoryUsage, error) {
+	categories, err := getCategories(conn)
+	if err != nil {
+		return nil, err
+	}
+	usage := []CategoryUsage{}
+	for _, category := range categories {
+		usage = append(usage, CategoryUsage{category.Name, category.UsedBytes, category.Objects, category.MaxBytes, category.MaxObjects})
+	}
+	return usage, nil
+}
+
+func GetUsage(w http.ResponseWriter, r *http.Request) {
+	usage, err := getUsage(&dbConnectionContext)
+	if err != nil {
+		JSONErrorFrom(w, r, err)
+		return
+	}
+	res, _ := json.Marshal(usage)
+	JSONResponseFromString(w, "{\"result\":"+string(res)+"}")
+}
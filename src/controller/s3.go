@@ -0,0 +1,982 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+//																														//
+// S3 gateway																											//
+//																														//
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+// The gateway speaks enough of the S3 REST API (path style requests only)
+// for the usual tools to work against us. Buckets are categories and keys
+// are paths; everything goes through the same directory, placement and
+// accounting as the native API. Cells hold strings, so object bodies are
+// kept base64url encoded and sizes are accounted in encoded bytes.
+
+const s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+const s3Encoding = "base64url"
+
+// cells get their payload in the URL, so we can't take anything big anyway
+const s3MaxBodySize = 4 << 20
+
+const s3MaxClockSkew = 15 * time.Minute
+
+// a presigned URL lasts a week at most
+const s3MaxPresignExpiry = 7 * 24 * time.Hour
+
+// access key id -> secret access key; the ids are those of API keys
+var s3Keys map[string]string
+
+// s3Now is what signatures are dated against
+var s3Now = time.Now
+
+type s3Upload struct {
+	UploadId  string     `bson:"_id"`
+	Category  string     `bson:"category"`
+	Path      string     `bson:"path"`
+	Meta      ObjectMeta `bson:"meta"`
+	Initiated time.Time  `bson:"initiated"`
+}
+
+type s3Part struct {
+	UploadId string `bson:"uploadid"`
+	Number   int    `bson:"number"`
+	Data     []byte `bson:"data"`
+	ETag     string `bson:"etag"`
+}
+
+type s3Error struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string   `xml:"Code"`
+	Message   string   `xml:"Message"`
+	Resource  string   `xml:"Resource"`
+	RequestId string   `xml:"RequestId"`
+	status    int
+	// retryAfter, if set, goes in a Retry-After header
+	retryAfter time.Duration
+}
+
+func (e *s3Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func newS3Error(status int, code string, message string) *s3Error {
+	return &s3Error{Code: code, Message: message, status: status}
+}
+
+var (
+	s3ErrAccessDenied       = newS3Error(http.StatusForbidden, "AccessDenied", "Access Denied")
+	s3ErrInvalidAccessKeyId = newS3Error(http.StatusForbidden, "InvalidAccessKeyId", "The access key you provided does not exist in our records")
+	s3ErrSignatureMismatch  = newS3Error(http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided")
+	s3ErrRequestExpired     = newS3Error(http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the current time is too large")
+	s3ErrBadDigest          = newS3Error(http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided x-amz-content-sha256 header does not match what was computed")
+	s3ErrTooLarge           = newS3Error(http.StatusBadRequest, "EntityTooLarge", "Your proposed upload exceeds the maximum allowed object size")
+	s3ErrNoSuchBucket       = newS3Error(http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+	s3ErrNoSuchKey          = newS3Error(http.StatusNotFound, "NoSuchKey", "The specified key does not exist")
+	s3ErrNoSuchUpload       = newS3Error(http.StatusNotFound, "NoSuchUpload", "The specified multipart upload does not exist")
+	s3ErrInvalidPart        = newS3Error(http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found")
+	s3ErrInvalidBucketName  = newS3Error(http.StatusBadRequest, "InvalidBucketName", "The specified bucket is not valid")
+	s3ErrBucketExists       = newS3Error(http.StatusConflict, "BucketAlreadyOwnedByYou", "Your previous request to create the named bucket succeeded")
+	s3ErrMalformedXML       = newS3Error(http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed")
+	s3ErrInvalidArgument    = newS3Error(http.StatusBadRequest, "InvalidArgument", "Invalid argument")
+	s3ErrSlowDown           = newS3Error(http.StatusServiceUnavailable, "SlowDown", "Please reduce your request rate")
+	s3ErrQuotaExceeded      = newS3Error(http.StatusForbidden, "QuotaExceeded", "The bucket has reached its storage quota")
+	s3ErrNotImplemented     = newS3Error(http.StatusNotImplemented, "NotImplemented", "A header you provided implies functionality that is not implemented")
+	s3ErrInternal           = newS3Error(http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.")
+)
+
+func s3RequestId() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return strings.ToUpper(hex.EncodeToString(id))
+}
+
+func s3WriteError(w http.ResponseWriter, r *http.Request, err *s3Error) {
+	response := *err
+	response.Resource = r.URL.Path
+	response.RequestId = requestId(r)
+	slog.DebugContext(r.Context(), "s3 error", "method", r.Method, "path", r.URL.Path, "error", err.Error())
+	w.Header().Set("x-amz-request-id", response.RequestId)
+	if err.retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(err.retryAfter)))
+	}
+	if r.Method == "HEAD" {
+		w.WriteHeader(err.status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(err.status)
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(response)
+}
+
+func s3WriteXML(w http.ResponseWriter, result interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	// logRequests has already given the request its id
+	w.Header().Set("x-amz-request-id", w.Header().Get(requestIdHeader))
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(result)
+}
+
+// s3ErrorFrom maps errors from the directory and the cells to S3 ones
+func s3ErrorFrom(r *http.Request, err error) *s3Error {
+	var known *s3Error
+	if errors.As(err, &known) {
+		return known
+	}
+	status, _ := errorStatus(err)
+	switch status {
+	case http.StatusBadRequest:
+		return s3ErrInvalidArgument
+	case http.StatusNotFound:
+		return s3ErrNoSuchKey
+	case http.StatusForbidden:
+		return s3ErrQuotaExceeded
+	case http.StatusInsufficientStorage:
+		// only a value bigger than a whole cell
+		return s3ErrTooLarge
+	case http.StatusServiceUnavailable:
+		if retryAfter, exists := retryAfterFrom(err); exists {
+			slowDown := *s3ErrSlowDown
+			slowDown.retryAfter = retryAfter
+			return &slowDown
+		}
+		return s3ErrSlowDown
+	default:
+		slog.ErrorContext(r.Context(), "internal error", "error", err)
+		return s3ErrInternal
+	}
+}
+
+func loadS3Keys() map[string]string {
+	keys := make(map[string]string)
+	add := func(line string) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			return
+		}
+		if colon := strings.Index(line, ":"); colon > 0 {
+			keys[line[:colon]] = line[colon+1:]
+		}
+	}
+	for _, pair := range strings.Split(os.Getenv("S3_ACCESS_KEYS"), ",") {
+		add(pair)
+	}
+	if path := os.Getenv("S3_KEYS_FILE"); path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			slog.Error("could not read S3 keys", "file", path, "error", err)
+			return keys
+		}
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			add(scanner.Text())
+		}
+	}
+	return keys
+}
+
+//
+// Signature V4
+//
+
+// s3URIEncode encodes the way the signature V4 spec wants it, which is
+// stricter than anything in net/url
+func s3URIEncode(value string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && keepSlash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	var pairs []string
+	for key, values := range query {
+		if key == "X-Amz-Signature" {
+			continue
+		}
+		for _, value := range values {
+			pairs = append(pairs, s3URIEncode(key, false)+"="+s3URIEncode(value, false))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+func s3CanonicalHeaders(r *http.Request, signedHeaders []string) string {
+	var b strings.Builder
+	for _, name := range signedHeaders {
+		var value string
+		switch name {
+		case "host":
+			value = r.Host
+		case "content-length":
+			value = strconv.FormatInt(r.ContentLength, 10)
+		default:
+			value = strings.Join(r.Header.Values(name), ",")
+		}
+		b.WriteString(name + ":" + strings.Join(strings.Fields(value), " ") + "\n")
+	}
+	return b.String()
+}
+
+func s3Hmac(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func s3Signature(secret string, scope []string, amzDate string, canonicalRequest string) string {
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + strings.Join(scope, "/") + "\n" + hex.EncodeToString(hashed[:])
+	key := s3Hmac([]byte("AWS4"+secret), scope[0])
+	for _, part := range scope[1:] {
+		key = s3Hmac(key, part)
+	}
+	return hex.EncodeToString(s3Hmac(key, stringToSign))
+}
+
+// s3Authenticate checks a signature V4 request, either signed in the
+// Authorization header or presigned in the query string, and returns the
+// access key id it was signed with. Streaming (aws-chunked) payloads are
+// not supported.
+func s3Authenticate(r *http.Request) (string, *s3Error) {
+	query := r.URL.Query()
+	var credential, signedHeaderList, signature, amzDate, payloadHash string
+	var expires time.Duration
+
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 ") {
+			return "", s3ErrAccessDenied
+		}
+		for _, field := range strings.Split(strings.TrimPrefix(auth, "AWS4-HMAC-SHA256 "), ",") {
+			field = strings.TrimSpace(field)
+			switch {
+			case strings.HasPrefix(field, "Credential="):
+				credential = strings.TrimPrefix(field, "Credential=")
+			case strings.HasPrefix(field, "SignedHeaders="):
+				signedHeaderList = strings.TrimPrefix(field, "SignedHeaders=")
+			case strings.HasPrefix(field, "Signature="):
+				signature = strings.TrimPrefix(field, "Signature=")
+			}
+		}
+		amzDate = r.Header.Get("X-Amz-Date")
+		payloadHash = r.Header.Get("X-Amz-Content-Sha256")
+		if payloadHash == "" {
+			payloadHash = "UNSIGNED-PAYLOAD"
+		}
+		expires = s3MaxClockSkew
+	} else if query.Get("X-Amz-Algorithm") == "AWS4-HMAC-SHA256" {
+		credential = query.Get("X-Amz-Credential")
+		signedHeaderList = query.Get("X-Amz-SignedHeaders")
+		signature = query.Get("X-Amz-Signature")
+		amzDate = query.Get("X-Amz-Date")
+		payloadHash = "UNSIGNED-PAYLOAD"
+		seconds, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+		expires = time.Duration(seconds) * time.Second
+		if err != nil || seconds <= 0 || expires > s3MaxPresignExpiry {
+			return "", s3ErrAccessDenied
+		}
+	} else {
+		return "", s3ErrAccessDenied
+	}
+
+	// Credential=AKID/20130524/us-east-1/s3/aws4_request
+	scope := strings.Split(credential, "/")
+	if len(scope) != 5 || scope[4] != "aws4_request" || signature == "" || signedHeaderList == "" {
+		return "", s3ErrAccessDenied
+	}
+	// without host signed, a signature could be replayed against another endpoint
+	signedHeaders := strings.Split(signedHeaderList, ";")
+	if !slices.Contains(signedHeaders, "host") {
+		return "", s3ErrAccessDenied
+	}
+	secret, known := s3Keys[scope[0]]
+	if !known {
+		return "", s3ErrInvalidAccessKeyId
+	}
+	when, err := time.Parse("20060102T150405Z", amzDate)
+	if err != nil || !strings.HasPrefix(amzDate, scope[1]) {
+		return "", s3ErrAccessDenied
+	}
+	if now := s3Now(); now.Sub(when) > expires || when.Sub(now) > s3MaxClockSkew {
+		return "", s3ErrRequestExpired
+	}
+	if strings.HasPrefix(payloadHash, "STREAMING-") {
+		return "", s3ErrNotImplemented
+	}
+
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		s3URIEncode(r.URL.Path, true),
+		s3CanonicalQuery(query),
+		s3CanonicalHeaders(r, signedHeaders),
+		signedHeaderList,
+		payloadHash,
+	}, "\n")
+	expected := s3Signature(secret, scope[1:], amzDate, canonicalRequest)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return "", s3ErrSignatureMismatch
+	}
+
+	// the body is only read here if the client signed its hash
+	if payloadHash != "UNSIGNED-PAYLOAD" {
+		body, err := s3ReadBody(r)
+		if err != nil {
+			return "", s3ErrorFrom(r, err)
+		}
+		sum := sha256.Sum256(body)
+		if hex.EncodeToString(sum[:]) != payloadHash {
+			return "", s3ErrBadDigest
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	return scope[0], nil
+}
+
+func s3ReadBody(r *http.Request) ([]byte, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, s3MaxBodySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > s3MaxBodySize {
+		return nil, s3ErrTooLarge
+	}
+	return body, nil
+}
+
+// s3RequiredPermission is what a request needs, and on which bucket, the
+// way requiredPermission has it for the native API
+func s3RequiredPermission(r *http.Request) (string, string) {
+	bucket, exists := mux.Vars(r)["bucket"]
+	switch {
+	case !exists:
+		return PermissionRead, ""
+	case r.Method == http.MethodPut && mux.Vars(r)["key"] == "":
+		// creating a bucket sets up a category
+		return PermissionAdmin, bucket
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		return PermissionRead, bucket
+	default:
+		return PermissionWrite, bucket
+	}
+}
+
+func s3AuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accessKeyId, s3Err := s3Authenticate(r)
+		if s3Err != nil {
+			s3WriteError(w, r, s3Err)
+			return
+		}
+		if !authEnabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key, err := getActiveAPIKey(r.Context(), &dbConnectionContext, accessKeyId)
+		if err != nil {
+			s3WriteError(w, r, s3ErrorFrom(r, err))
+			return
+		}
+		if key == nil {
+			slog.InfoContext(r.Context(), "S3 access key is not an API key, or it is revoked", "accesskey", accessKeyId)
+			s3WriteError(w, r, s3ErrInvalidAccessKeyId)
+			return
+		}
+		trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("eks.api_key", key.Id))
+		permission, bucket := s3RequiredPermission(r)
+		if !key.allows(permission, bucket) {
+			slog.InfoContext(r.Context(), "API key not allowed", "apikey", key.Id, "permission", permission, "category", bucket)
+			s3WriteError(w, r, s3ErrAccessDenied)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+//
+// Helpers
+//
+
+func s3ObjectMeta(r *http.Request, payload string) ObjectMeta {
+	now := time.Now().UTC()
+	meta := ObjectMeta{Checksum: Checksum(payload), ContentType: r.Header.Get("Content-Type"),
+		Encoding: s3Encoding, Created: now, Modified: now}
+	if meta.ContentType == "" {
+		meta.ContentType = "binary/octet-stream"
+	}
+	for name, values := range r.Header {
+		if strings.HasPrefix(name, "X-Amz-Meta-") && len(values) > 0 {
+			if meta.Metadata == nil {
+				meta.Metadata = make(map[string]string)
+			}
+			meta.Metadata[strings.ToLower(strings.TrimPrefix(name, "X-Amz-Meta-"))] = values[0]
+		}
+	}
+	return meta
+}
+
+// s3ObjectSize is the size the client gave us, not what the cells hold
+func s3ObjectSize(size int64, encoding string) int64 {
+	if encoding == s3Encoding {
+		return int64(base64.RawURLEncoding.DecodedLen(int(size)))
+	}
+	return size
+}
+
+func s3ObjectHeaders(w http.ResponseWriter, entry Directory) {
+	w.Header().Set("Content-Type", entry.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(s3ObjectSize(objectSize(entry.Size, entry.Envelope), entry.Encoding), 10))
+	w.Header().Set("ETag", "\""+entry.Checksum+"\"")
+	if !entry.Modified.IsZero() {
+		w.Header().Set("Last-Modified", entry.Modified.Format(http.TimeFormat))
+	}
+	if entry.Version > 0 {
+		w.Header().Set("x-amz-version-id", strconv.FormatInt(entry.Version, 10))
+	}
+	for name, value := range entry.Metadata {
+		w.Header().Set("x-amz-meta-"+name, value)
+	}
+}
+
+func s3BucketExists(conn *DBConnectionContext, bucket string) (bool, error) {
+	if bucket == "default" {
+		return true, nil
+	}
+	count, err := conn.categories.CountDocuments(context.TODO(), bson.D{{"_id", bucket}})
+	return count > 0, err
+}
+
+// s3Bucket checks the bucket in the request exists, and writes the error
+// if it does not
+func s3Bucket(w http.ResponseWriter, r *http.Request) (string, bool) {
+	bucket := mux.Vars(r)["bucket"]
+	exists, err := s3BucketExists(&dbConnectionContext, bucket)
+	if err != nil {
+		s3WriteError(w, r, s3ErrorFrom(r, err))
+		return "", false
+	}
+	if !exists {
+		s3WriteError(w, r, s3ErrNoSuchBucket)
+		return "", false
+	}
+	return bucket, true
+}
+
+func s3RequestedEntry(r *http.Request, bucket string, key string) (Directory, error) {
+	if version := r.URL.Query().Get("versionId"); version != "" {
+		number, err := strconv.ParseInt(version, 10, 64)
+		if err != nil {
+			return Directory{}, s3ErrInvalidArgument
+		}
+		entry, err := getDirectoryVersion(&dbConnectionContext, bucket, key, number)
+		if err == nil && entry.Deleted {
+			err = mongo.ErrNoDocuments
+		}
+		return entry, err
+	}
+	entry, err := getDirectoryEntry(&dbConnectionContext, bucket, key)
+	if err == nil && entry.Deleted {
+		err = mongo.ErrNoDocuments
+	}
+	return entry, err
+}
+
+//
+// Buckets
+//
+
+type s3BucketInfo struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+type s3ListAllMyBucketsResult struct {
+	XMLName xml.Name       `xml:"ListAllMyBucketsResult"`
+	Xmlns   string         `xml:"xmlns,attr"`
+	OwnerId string         `xml:"Owner>ID"`
+	Buckets []s3BucketInfo `xml:"Buckets>Bucket"`
+}
+
+func S3ListBuckets(w http.ResponseWriter, r *http.Request) {
+	categories, err := getCategories(&dbConnectionContext)
+	if err != nil {
+		s3WriteError(w, r, s3ErrorFrom(r, err))
+		return
+	}
+	result := s3ListAllMyBucketsResult{Xmlns: s3Namespace, OwnerId: "elastic-kubernetes-storage"}
+	hasDefault := false
+	for _, category := range categories {
+		hasDefault = hasDefault || category.Name == "default"
+		result.Buckets = append(result.Buckets, s3BucketInfo{category.Name, category.Created.Format(time.RFC3339)})
+	}
+	if !hasDefault {
+		result.Buckets = append(result.Buckets, s3BucketInfo{"default", time.Time{}.Format(time.RFC3339)})
+	}
+	s3WriteXML(w, result)
+}
+
+// bucket names follow the S3 rules, which also keeps them sane as categories
+func s3ValidBucketName(name string) bool {
+	if len(name) < 3 || len(name) > 63 {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !((c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+func S3CreateBucket(w http.ResponseWriter, r *http.Request) {
+	bucket := mux.Vars(r)["bucket"]
+	if !s3ValidBucketName(bucket) {
+		s3WriteError(w, r, s3ErrInvalidBucketName)
+		return
+	}
+	err := createCategory(&dbConnectionContext, bucket)
+	if mongo.IsDuplicateKeyError(err) {
+		s3WriteError(w, r, s3ErrBucketExists)
+		return
+	} else if err != nil {
+		s3WriteError(w, r, s3ErrorFrom(r, err))
+		return
+	}
+	w.Header().Set("Location", "/"+bucket)
+	w.WriteHeader(http.StatusOK)
+}
+
+func S3HeadBucket(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s3Bucket(w, r); ok {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+type s3Contents struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type s3CommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type s3ListBucketResult struct {
+	XMLName               xml.Name         `xml:"ListBucketResult"`
+	Xmlns                 string           `xml:"xmlns,attr"`
+	Name                  string           `xml:"Name"`
+	Prefix                string           `xml:"Prefix"`
+	Delimiter             string           `xml:"Delimiter,omitempty"`
+	StartAfter            string           `xml:"StartAfter,omitempty"`
+	MaxKeys               int              `xml:"MaxKeys"`
+	KeyCount              int              `xml:"KeyCount"`
+	IsTruncated           bool             `xml:"IsTruncated"`
+	ContinuationToken     string           `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string           `xml:"NextContinuationToken,omitempty"`
+	Contents              []s3Contents     `xml:"Contents"`
+	CommonPrefixes        []s3CommonPrefix `xml:"CommonPrefixes"`
+}
+
+// S3ListObjects answers ListObjectsV2, with the continuation tokens of our
+// own listing
+func S3ListObjects(w http.ResponseWriter, r *http.Request) {
+	bucket, ok := s3Bucket(w, r)
+	if !ok {
+		return
+	}
+	query := r.URL.Query()
+	maxKeys := maxListLimit
+	if query.Get("max-keys") != "" {
+		number, err := strconv.Atoi(query.Get("max-keys"))
+		if err != nil || number < 0 {
+			s3WriteError(w, r, s3ErrInvalidArgument)
+			return
+		}
+		if number < maxListLimit {
+			maxKeys = number
+		}
+	}
+	after := query.Get("start-after")
+	if token := query.Get("continuation-token"); token != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(token)
+		if err != nil {
+			s3WriteError(w, r, s3ErrInvalidArgument)
+			return
+		}
+		after = string(decoded)
+	}
+	result := s3ListBucketResult{Xmlns: s3Namespace, Name: bucket, Prefix: query.Get("prefix"),
+		Delimiter: query.Get("delimiter"), StartAfter: query.Get("start-after"), MaxKeys: maxKeys,
+		ContinuationToken: query.Get("continuation-token")}
+	if maxKeys > 0 {
+		listing, err := listObjects(&dbConnectionContext, bucket, result.Prefix, result.Delimiter, after, maxKeys)
+		if err != nil {
+			s3WriteError(w, r, s3ErrorFrom(r, err))
+			return
+		}
+		for _, object := range listing.Objects {
+			result.Contents = append(result.Contents, s3Contents{Key: object.Path,
+				LastModified: object.Modified.Format("2006-01-02T15:04:05.000Z"), ETag: "\"" + object.Checksum + "\"",
+				Size: s3ObjectSize(object.Size, object.Encoding), StorageClass: "STANDARD"})
+		}
+		for _, prefix := range listing.CommonPrefixes {
+			result.CommonPrefixes = append(result.CommonPrefixes, s3CommonPrefix{prefix})
+		}
+		result.KeyCount = len(result.Contents) + len(result.CommonPrefixes)
+		result.IsTruncated = listing.Truncated
+		result.NextContinuationToken = listing.Continuation
+	}
+	s3WriteXML(w, result)
+}
+
+//
+// Objects
+//
+
+func S3PutObject(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	bucket, ok := s3Bucket(w, r)
+	if !ok {
+		return
+	}
+	if r.Header.Get("X-Amz-Copy-Source") != "" {
+		s3WriteError(w, r, s3ErrNotImplemented)
+		return
+	}
+	body, err := s3ReadBody(r)
+	if err != nil {
+		s3WriteError(w, r, s3ErrorFrom(r, err))
+		return
+	}
+	key := mux.Vars(r)["key"]
+	payload := base64.RawURLEncoding.EncodeToString(body)
+	entry, err := putObject(ctx, &dbConnectionContext, bucket, key, payload, s3ObjectMeta(r, payload))
+	if err != nil {
+		s3WriteError(w, r, s3ErrorFrom(r, err))
+		return
+	}
+	CheckScaleUp(ctx, &dbConnectionContext)
+	w.Header().Set("ETag", "\""+entry.Checksum+"\"")
+	if entry.Version > 0 {
+		w.Header().Set("x-amz-version-id", strconv.FormatInt(entry.Version, 10))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func S3GetObject(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	bucket, ok := s3Bucket(w, r)
+	if !ok {
+		return
+	}
+	entry, err := s3RequestedEntry(r, bucket, mux.Vars(r)["key"])
+	if err != nil {
+		s3WriteError(w, r, s3ErrorFrom(r, err))
+		return
+	}
+	value, err := readObject(ctx, entry)
+	if err != nil {
+		s3WriteError(w, r, s3ErrorFrom(r, err))
+		return
+	}
+	body := []byte(value)
+	if entry.Encoding == s3Encoding {
+		body, err = base64.RawURLEncoding.DecodeString(value)
+		if err != nil {
+			s3WriteError(w, r, s3ErrorFrom(r, err))
+			return
+		}
+	}
+	s3ObjectHeaders(w, entry)
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+func S3HeadObject(w http.ResponseWriter, r *http.Request) {
+	bucket, ok := s3Bucket(w, r)
+	if !ok {
+		return
+	}
+	entry, err := s3RequestedEntry(r, bucket, mux.Vars(r)["key"])
+	if err != nil {
+		s3WriteError(w, r, s3ErrorFrom(r, err))
+		return
+	}
+	s3ObjectHeaders(w, entry)
+	w.WriteHeader(http.StatusOK)
+}
+
+// S3DeleteObject succeeds for keys that do not exist, as S3 does
+func S3DeleteObject(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	bucket, ok := s3Bucket(w, r)
+	if !ok {
+		return
+	}
+	key := mux.Vars(r)["key"]
+	var err error
+	if version := r.URL.Query().Get("versionId"); version != "" {
+		number, parseErr := strconv.ParseInt(version, 10, 64)
+		if parseErr != nil {
+			s3WriteError(w, r, s3ErrInvalidArgument)
+			return
+		}
+		_, err = purgeVersion(ctx, &dbConnectionContext, bucket, key, number)
+	} else if isVersioned(&dbConnectionContext, bucket, key) {
+		_, err = deleteVersion(ctx, &dbConnectionContext, bucket, key)
+	} else {
+		_, err = deleteObject(ctx, &dbConnectionContext, bucket, key)
+	}
+	if err != nil && err != mongo.ErrNoDocuments {
+		s3WriteError(w, r, s3ErrorFrom(r, err))
+		return
+	}
+	CheckScaleDown(ctx, &dbConnectionContext)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//
+// Multipart uploads
+//
+
+// Parts are kept in Mongo until the upload is completed, and only then
+// does the whole object go to a cell.
+
+type s3InitiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadId string   `xml:"UploadId"`
+}
+
+type s3CompleteMultipartUpload struct {
+	Parts []struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+}
+
+type s3CompleteMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag"`
+}
+
+func s3GetUpload(conn *DBConnectionContext, r *http.Request) (s3Upload, error) {
+	var upload s3Upload
+	vars := mux.Vars(r)
+	err := conn.multipartuploads.FindOne(context.TODO(), bson.D{{"_id", r.URL.Query().Get("uploadId")},
+		{"category", vars["bucket"]}, {"path", vars["key"]}}).Decode(&upload)
+	if err == mongo.ErrNoDocuments {
+		return upload, s3ErrNoSuchUpload
+	}
+	return upload, err
+}
+
+func s3RemoveUpload(conn *DBConnectionContext, uploadId string) error {
+	_, err := conn.multipartparts.DeleteMany(context.TODO(), bson.D{{"uploadid", uploadId}})
+	if err != nil {
+		return err
+	}
+	_, err = conn.multipartuploads.DeleteOne(context.TODO(), bson.D{{"_id", uploadId}})
+	return err
+}
+
+func S3CreateMultipartUpload(w http.ResponseWriter, r *http.Request) {
+	bucket, ok := s3Bucket(w, r)
+	if !ok {
+		return
+	}
+	upload := s3Upload{UploadId: s3RequestId() + s3RequestId(), Category: bucket, Path: mux.Vars(r)["key"],
+		Meta: s3ObjectMeta(r, ""), Initiated: time.Now().UTC()}
+	_, err := dbConnectionContext.multipartuploads.InsertOne(context.TODO(), upload)
+	if err != nil {
+		s3WriteError(w, r, s3ErrorFrom(r, err))
+		return
+	}
+	s3WriteXML(w, s3InitiateMultipartUploadResult{Xmlns: s3Namespace, Bucket: bucket, Key: upload.Path, UploadId: upload.UploadId})
+}
+
+func S3UploadPart(w http.ResponseWriter, r *http.Request) {
+	number, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || number < 1 || number > 10000 {
+		s3WriteError(w, r, s3ErrInvalidArgument)
+		return
+	}
+	upload, err := s3GetUpload(&dbConnectionContext, r)
+	if err != nil {
+		s3WriteError(w, r, s3ErrorFrom(r, err))
+		return
+	}
+	body, err := s3ReadBody(r)
+	if err != nil {
+		s3WriteError(w, r, s3ErrorFrom(r, err))
+		return
+	}
+	sum := sha256.Sum256(body)
+	part := s3Part{UploadId: upload.UploadId, Number: number, Data: body, ETag: hex.EncodeToString(sum[:])}
+	_, err = dbConnectionContext.multipartparts.ReplaceOne(context.TODO(),
+		bson.D{{"uploadid", part.UploadId}, {"number", part.Number}}, part, options.Replace().SetUpsert(true))
+	if err != nil {
+		s3WriteError(w, r, s3ErrorFrom(r, err))
+		return
+	}
+	w.Header().Set("ETag", "\""+part.ETag+"\"")
+	w.WriteHeader(http.StatusOK)
+}
+
+func S3CompleteMultipartUpload(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	upload, err := s3GetUpload(&dbConnectionContext, r)
+	if err != nil {
+		s3WriteError(w, r, s3ErrorFrom(r, err))
+		return
+	}
+	body, err := s3ReadBody(r)
+	if err != nil {
+		s3WriteError(w, r, s3ErrorFrom(r, err))
+		return
+	}
+	var request s3CompleteMultipartUpload
+	if err = xml.Unmarshal(body, &request); err != nil || len(request.Parts) == 0 {
+		s3WriteError(w, r, s3ErrMalformedXML)
+		return
+	}
+
+	var object []byte
+	for i, requested := range request.Parts {
+		if i > 0 && requested.PartNumber <= request.Parts[i-1].PartNumber {
+			s3WriteError(w, r, newS3Error(http.StatusBadRequest, "InvalidPartOrder", "The list of parts was not in ascending order"))
+			return
+		}
+		var part s3Part
+		err = dbConnectionContext.multipartparts.FindOne(context.TODO(),
+			bson.D{{"uploadid", upload.UploadId}, {"number", requested.PartNumber}}).Decode(&part)
+		if err != nil || strings.Trim(requested.ETag, "\"") != part.ETag {
+			s3WriteError(w, r, s3ErrInvalidPart)
+			return
+		}
+		object = append(object, part.Data...)
+		if len(object) > s3MaxBodySize {
+			s3WriteError(w, r, s3ErrTooLarge)
+			return
+		}
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(object)
+	meta := upload.Meta
+	meta.Checksum = Checksum(payload)
+	meta.Modified = time.Now().UTC()
+	entry, err := putObject(ctx, &dbConnectionContext, upload.Category, upload.Path, payload, meta)
+	if err != nil {
+		s3WriteError(w, r, s3ErrorFrom(r, err))
+		return
+	}
+	if err = s3RemoveUpload(&dbConnectionContext, upload.UploadId); err != nil {
+		slog.WarnContext(ctx, "could not clean up upload", "upload", upload.UploadId, "error", err)
+	}
+	CheckScaleUp(ctx, &dbConnectionContext)
+	s3WriteXML(w, s3CompleteMultipartUploadResult{Xmlns: s3Namespace, Location: "/" + upload.Category + "/" + upload.Path,
+		Bucket: upload.Category, Key: upload.Path, ETag: "\"" + entry.Checksum + "\""})
+}
+
+func S3AbortMultipartUpload(w http.ResponseWriter, r *http.Request) {
+	upload, err := s3GetUpload(&dbConnectionContext, r)
+	if err != nil {
+		s3WriteError(w, r, s3ErrorFrom(r, err))
+		return
+	}
+	if err = s3RemoveUpload(&dbConnectionContext, upload.UploadId); err != nil {
+		s3WriteError(w, r, s3ErrorFrom(r, err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func newS3Router() *mux.Router {
+	r := mux.NewRouter().SkipClean(true)
+	r.Use(traceRequests("s3"))
+	r.Use(logRequests)
+	r.Use(instrumentRoutes("s3"))
+	r.Use(s3AuthMiddleware)
+	r.Use(preferWait)
+	r.HandleFunc("/", S3ListBuckets).Methods("GET")
+
+	r.HandleFunc("/{bucket}", S3CreateBucket).Methods("PUT")
+	r.HandleFunc("/{bucket}", S3HeadBucket).Methods("HEAD")
+	r.HandleFunc("/{bucket}", S3ListObjects).Methods("GET")
+	r.HandleFunc("/{bucket}/", S3ListObjects).Methods("GET")
+
+	r.HandleFunc("/{bucket}/{key:.+}", S3UploadPart).Methods("PUT").Queries("partNumber", "", "uploadId", "")
+	r.HandleFunc("/{bucket}/{key:.+}", S3PutObject).Methods("PUT")
+	r.HandleFunc("/{bucket}/{key:.+}", S3CreateMultipartUpload).Methods("POST").Queries("uploads", "")
+	r.HandleFunc("/{bucket}/{key:.+}", S3CompleteMultipartUpload).Methods("POST").Queries("uploadId", "")
+	r.HandleFunc("/{bucket}/{key:.+}", S3GetObject).Methods("GET")
+	r.HandleFunc("/{bucket}/{key:.+}", S3HeadObject).Methods("HEAD")
+	r.HandleFunc("/{bucket}/{key:.+}", S3AbortMultipartUpload).Methods("DELETE").Queries("uploadId", "")
+	r.HandleFunc("/{bucket}/{key:.+}", S3DeleteObject).Methods("DELETE")
+	return r
+}
+
+func StartS3Gateway(port string) {
+	s3Keys = loadS3Keys()
+	if len(s3Keys) == 0 {
+		slog.Info("no S3 access keys configured, S3 gateway not started")
+		return
+	}
+	slog.Info("S3 gateway started", "port", port, "keys", len(s3Keys))
+	if err := http.ListenAndServe(":"+port, newS3Router()); err != nil {
+		slog.Error("S3 gateway stopped", "error", err)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+//																														//
+// Service status																										//
+//																														//
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+// /status answers from memory and the cellstatus collection only. Whether
+// the cells are alive comes from a health checker probing all of them in
+// the background, so a dead cell neither slows /status down nor hides the
+// cells after it.
+
+// CellHealth is what the health checker last found out about a cell
+type CellHealth struct {
+	Healthy     bool      `json:"healthy"`
+	LastSeen    time.Time `json:"lastseen"`
+	LastChecked time.Time `json:"lastchecked"`
+	LastError   string    `json:"lasterror,omitempty"`
+}
+
+var cellHealth = make(map[int]CellHealth)
+var cellHealthLock sync.Mutex
+
+// checkCell probes one cell. It goes around the circuit breakers on
+// purpose: a cell whose circuit is open may well be back.
+func checkCell(cellid int) error {
+	ctx, cancel := context.WithTimeout(backgroundContext("health"), cellHealthTimeout)
+	defer cancel()
+	if useCellGrpc() {
+		return grpcCellHealth(ctx, cellid)
+	}
+	_, err := cellRequest(ctx, cellid, "GET", makeCellHealthcheck(cellid), "")
+	return err
+}
+
+// checkCells probes every cell at once and records the results, forgetting
+// cells that are gone after a scale down
+func checkCells() {
+	cells := serverstatus.NumberOfCells
+	results := make([]error, cells)
+	var wait sync.WaitGroup
+	for cellid := 0; cellid < cells; cellid++ {
+		wait.Add(1)
+		go func(cellid int) {
+			defer wait.Done()
+			results[cellid] = checkCell(cellid)
+		}(cellid)
+	}
+	wait.Wait()
+
+	now := time.Now().UTC()
+	cellHealthLock.Lock()
+	defer cellHealthLock.Unlock()
+	for cellid, err := range results {
+		health := cellHealth[cellid]
+		health.LastChecked = now
+		health.Healthy = err == nil
+		if err == nil {
+			health.LastSeen = now
+			health.LastError = ""
+		} else {
+			if cellHealth[cellid].Healthy {
+				slog.Warn("cell stopped answering", "cell", cellid, "error", err)
+			}
+			health.LastError = err.Error()
+		}
+		cellHealth[cellid] = health
+	}
+	for cellid := range cellHealth {
+		if cellid >= cells {
+			delete(cellHealth, cellid)
+		}
+	}
+}
+
+func HealthChecker(interval time.Duration) {
+	for {
+		checkCells()
+		time.Sleep(interval)
+	}
+}
+
+func getCellHealth() map[int]CellHealth {
+	cellHealthLock.Lock()
+	defer cellHealthLock.Unlock()
+	health := make(map[int]CellHealth, len(cellHealth))
+	for cellid, h := range cellHealth {
+		health[cellid] = h
+	}
+	return health
+}
+
+// Operation is the last scale up, drain, scale down or rebalance. Result is
+// "running" until it finishes, then "ok", "failed" or "cancelled".
+type Operation struct {
+	Name     string     `json:"name"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Result   string     `json:"result"`
+	Error    string     `json:"error,omitempty"`
+	// Skipped counts keys a drain or rebalance left alone because the
+	// directory no longer had them where the cell listing said
+	Skipped int `json:"skipped,omitempty"`
+}
+
+var lastOperation *Operation
+var lastOperationLock sync.Mutex
+
+func startOperation(name string) {
+	lastOperationLock.Lock()
+	defer lastOperationLock.Unlock()
+	lastOperation = &Operation{Name: name, Started: time.Now().UTC(), Result: "running"}
+}
+
+func finishOperation(result string, err error) {
+	lastOperationLock.Lock()
+	defer lastOperationLock.Unlock()
+	if lastOperation == nil {
+		return
+	}
+	finished := time.Now().UTC()
+	lastOperation.Finished = &finished
+	lastOperation.Result = result
+	if err != nil {
+		lastOperation.Error = err.Error()
+	}
+}
+
+func skipOperationKey() {
+	lastOperationLock.Lock()
+	defer lastOperationLock.Unlock()
+	if lastOperation != nil {
+		lastOperation.Skipped++
+	}
+}
+
+func getLastOperation() *Operation {
+	lastOperationLock.Lock()
+	defer lastOperationLock.Unlock()
+	if lastOperation == nil {
+		return nil
+	}
+	operation := *lastOperation
+	return &operation
+}
+
+// CellReport is one cell as shown on /status. Healthy is false, and
+// LastSeen missing, for a cell the health checker has not reached yet.
+type CellReport struct {
+	CellId      int        `json:"cellid"`
+	Capacity    int64      `json:"capacity"`
+	FreeSpace   int64      `json:"freespace"`
+	Objects     int64      `json:"objects"`
+	Healthy     bool       `json:"healthy"`
+	LastSeen    *time.Time `json:"lastseen,omitempty"`
+	LastError   string     `json:"lasterror,omitempty"`
+	CircuitOpen bool       `json:"circuitopen"`
+}
+
+type ServiceStatus struct {
+	Revision            int          `json:"revision"`
+	State               string       `json:"state"`
+	CellsAlive          int          `json:"cells-alive"`
+	NumberOfCells       int          `json:"numberofcells"`
+	TotalSpace          int64        `json:"totalspace"`
+	UsedSpace           int64        `json:"usedspace"`
+	SUT                 int64        `json:"suthreshold"`
+	SDT                 int64        `json:"sdthreshold"`
+	ChecksumMismatches  int64        `json:"checksummismatches"`
+	CorruptionsReported int64        `json:"corruptionsreported"`
+	OpenCircuits        []int        `json:"opencircuits"`
+	Cells               []CellReport `json:"cells"`
+	LastOperation       *Operation   `json:"lastoperation"`
+}
+
+func GetServiceStatus(w http.ResponseWriter, r *http.Request) {
+	statuses, err := getCellStatuses(&dbConnectionContext)
+	if err != nil {
+		JSONErrorFrom(w, r, err)
+		return
+	}
+	health := getCellHealth()
+	circuits := openCircuits()
+	open := make(map[int]bool, len(circuits))
+	for _, cellid := range circuits {
+		open[cellid] = true
+	}
+
+	status := ServiceStatus{
+		Revision:            revision,
+		State:               ServerState.String(),
+		NumberOfCells:       serverstatus.NumberOfCells,
+		TotalSpace:          serverstatus.TotalSpace,
+		UsedSpace:           serverstatus.UsedSpace,
+		SUT:                 serverstatus.SUT,
+		SDT:                 serverstatus.SDT,
+		ChecksumMismatches:  atomic.LoadInt64(&checksumMismatches),
+		CorruptionsReported: atomic.LoadInt64(&corruptionsReported),
+		OpenCircuits:        circuits,
+		Cells:               []CellReport{},
+		LastOperation:       getLastOperation(),
+	}
+	for cellid := 0; cellid < serverstatus.NumberOfCells; cellid++ {
+		cellStatus := statuses[cellid]
+		report := CellReport{CellId: cellid, Capacity: cellStatus.Capacity, FreeSpace: cellStatus.FreeSpace,
+			Objects: cellStatus.NumberOfFiles, CircuitOpen: open[cellid]}
+		if h, checked := health[cellid]; checked {
+			report.Healthy = h.Healthy
+			report.LastError = h.LastError
+			if !h.LastSeen.IsZero() {
+				lastSeen := h.LastSeen
+				report.LastSeen = &lastSeen
+			}
+		}
+		if report.Healthy {
+			status.CellsAlive++
+		}
+		status.Cells = append(status.Cells, report)
+	}
+
+	res, _ := json.Marshal(status)
+	JSONResponseFromString(w, string(res))
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+//																														//
+// Tracing																												//
+//																														//
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+// OpenTelemetry spans for each request and for the steps of a store that
+// may be slow: the directory lookup, the search for a cell with room, the
+// call to the cell and the accounting. The trace context goes on to the
+// cells in the W3C traceparent header, over HTTP and gRPC alike.
+//
+// OTEL_TRACES_EXPORTER picks where spans go: "otlp" for a collector at
+// OTEL_EXPORTER_OTLP_ENDPOINT (gRPC, localhost:4317 unless set), "console"
+// for stdout, and nowhere by default. The other OTEL_ variables, like
+// OTEL_TRACES_SAMPLER or OTEL_SERVICE_NAME, work as usual.
+
+var tracer = otel.Tracer("k8s-elastic-storage/controller")
+
+func setupTracing(service string) error {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch strings.ToLower(os.Getenv("OTEL_TRACES_EXPORTER")) {
+	case "otlp":
+		exporter, err = otlptracegrpc.New(context.Background())
+	case "console", "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	default:
+		// spans are not recorded, but a caller's trace context still
+		// reaches the cells
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	res, err := resource.New(context.Background(),
+		resource.WithAttributes(semconv.ServiceName(service)),
+		resource.WithFromEnv(), resource.WithTelemetrySDK())
+	if err != nil {
+		return err
+	}
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res)))
+	slog.Info("tracing enabled", "exporter", os.Getenv("OTEL_TRACES_EXPORTER"))
+	return nil
+}
+
+// traceRequests is mux middleware starting a server span for each request,
+// named after the route template like the metrics are. The path itself is
+// left out of the span, as it is from the logs, since the REST API carries
+// payloads in it.
+func traceRequests(api string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			route := "unknown"
+			if current := mux.CurrentRoute(r); current != nil {
+				if template, err := current.GetPathTemplate(); err == nil {
+					route = template
+				}
+			}
+			if quietRoutes[route] {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+			ctx, span := tracer.Start(ctx, r.Method+" "+route, trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(attribute.String("eks.api", api), attribute.String("http.request.method", r.Method),
+					attribute.String("http.route", route)))
+			defer span.End()
+			recorder := &statusRecorder{w, http.StatusOK}
+			next.ServeHTTP(recorder, r.WithContext(ctx))
+			span.SetAttributes(attribute.Int("http.response.status_code", recorder.status))
+			if recorder.status >= 500 {
+				span.SetStatus(otelcodes.Error, http.StatusText(recorder.status))
+			}
+		})
+	}
+}
+
+// injectTraceContext puts ctx's trace context in the headers of a request
+// to a cell
+func injectTraceContext(ctx context.Context, header http.Header) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+// endSpan marks the span failed if err is set, and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(otelcodes.Error, err.Error())
+	}
+	span.End()
+}
+
+func cellAttribute(cellid int) attribute.KeyValue {
+	return attribute.Int("eks.cell", cellid)
+}
@@ -0,0 +1,622 @@
+// eks is a command line client for the elastic storage controller.
+//
+//	eks [-controller URL] [-key KEY] [-o table|json] <command> [arguments]
+//
+// The controller is found through -controller, then EKS_CONTROLLER, then
+// http://localhost:2222, which is where
+//
+//	kubectl port-forward service/k8s-elastic-storage-service 2222
+//
+// puts it. The API key comes from -key or EKS_API_KEY. Run eks without arguments for the list of commands.
+//
+// eks is built from the GOPATH the Dockerfiles use, with src/client as
+// github.com/agiratech/docker_imgs/client next to it.
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/agiratech/docker_imgs/client"
+)
+
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+//																														//
+// Controller API																										//
+//																														//
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+// Everything goes through the client package, which the Go programs
+// talking to the controller use too.
+
+var api *client.Client
+
+// requestTimeout is long enough for the slowest command, fsck
+const requestTimeout = 5 * time.Minute
+
+// checkValue catches values the routes cannot carry before the client
+// does, to say what to do about it
+func checkValue(value string) error {
+	if value == "" {
+		return errors.New("there is nothing to store")
+	}
+	if strings.Contains(value, "/") {
+		return errors.New("the value contains '/', store it without -raw")
+	}
+	return nil
+}
+
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+//																														//
+// Output																												//
+//																														//
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+var outputFormat string
+
+func printJSON(v interface{}) {
+	res, _ := json.MarshalIndent(v, "", "  ")
+	fmt.Println(string(res))
+}
+
+func newTable() *tabwriter.Writer {
+	return tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+}
+
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit && n > -unit {
+		return strconv.FormatInt(n, 10) + " B"
+	}
+	value := float64(n)
+	suffix := 0
+	for value >= unit || value <= -unit {
+		value /= unit
+		suffix++
+	}
+	return strconv.FormatFloat(value, 'f', 1, 64) + " " + "KMGTPE"[suffix-1:suffix] + "iB"
+}
+
+func percent(part int64, whole int64) string {
+	if whole <= 0 {
+		return "-"
+	}
+	return strconv.FormatFloat(100*float64(part)/float64(whole), 'f', 1, 64) + "%"
+}
+
+// sinceString is how long ago t was, to the second
+func sinceString(t time.Time) string {
+	return time.Since(t).Round(time.Second).String() + " ago"
+}
+
+func intsToString(values []int) string {
+	if len(values) == 0 {
+		return "none"
+	}
+	parts := make([]string, len(values))
+	for i, value := range values {
+		parts[i] = strconv.Itoa(value)
+	}
+	return strings.Join(parts, ", ")
+}
+
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+//																														//
+// Object commands																										//
+//																														//
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+// metaFlags collects repeated -meta key=value flags
+type metaFlags map[string]string
+
+func (m metaFlags) String() string {
+	return ""
+}
+
+func (m metaFlags) Set(value string) error {
+	i := strings.Index(value, "=")
+	if i < 1 {
+		return errors.New("expected key=value")
+	}
+	m[value[:i]] = value[i+1:]
+	return nil
+}
+
+func readInput(name string) ([]byte, error) {
+	if name == "" || name == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(name)
+}
+
+// Payloads travel in the URL, so unless told otherwise we store them
+// base64url encoded, which keeps binary data and slashes intact. get
+// decodes them again from the X-Object-Encoding header.
+func cmdPut(args []string) error {
+	fs := flag.NewFlagSet("put", flag.ExitOnError)
+	raw := fs.Bool("raw", false, "store the data as it is instead of base64url encoded")
+	update := fs.Bool("update", false, "replace an existing object, fail if there is none")
+	overwrite := fs.Bool("overwrite", false, "replace the object if it exists")
+	contentType := fs.String("type", "", "content type to record with the object")
+	meta := metaFlags{}
+	fs.Var(meta, "meta", "key=value metadata to record with the object (repeatable)")
+	fs.Usage = usageFor(fs, "put [flags] PATH [FILE|-]", "Stores FILE, or stdin, as PATH.")
+	fs.Parse(args)
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	data, err := readInput(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	opts := &client.StoreOptions{Overwrite: *overwrite, ContentType: *contentType, Metadata: meta}
+	value := string(data)
+	if !*raw {
+		value = base64.RawURLEncoding.EncodeToString(data)
+		opts.Encoding = "base64url"
+	}
+	if err := checkValue(value); err != nil {
+		return err
+	}
+	var result *client.StoreResult
+	if *update {
+		result, err = api.Update(context.Background(), fs.Arg(0), value, opts)
+	} else {
+		result, err = api.Store(context.Background(), fs.Arg(0), value, opts)
+	}
+	if err != nil {
+		return err
+	}
+	if outputFormat == "json" {
+		printJSON(map[string]interface{}{"path": fs.Arg(0), "bytes": result.Bytes, "version": result.Version, "checksum": result.Checksum})
+		return nil
+	}
+	line := "stored " + fs.Arg(0) + " (" + humanBytes(int64(len(data))) + ")"
+	if result.Version > 0 {
+		line += ", version " + strconv.FormatInt(result.Version, 10)
+	}
+	fmt.Println(line)
+	return nil
+}
+
+func cmdGet(args []string) error {
+	fs := flag.NewFlagSet("get", flag.ExitOnError)
+	version := fs.Int64("version", 0, "get this version of a versioned object")
+	out := fs.String("out", "", "write to this file instead of stdout")
+	fs.Usage = usageFor(fs, "get [flags] PATH", "Writes the contents of PATH to stdout.")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	var object *client.Object
+	var err error
+	if *version > 0 {
+		object, err = api.RetrieveVersion(context.Background(), fs.Arg(0), *version)
+	} else {
+		object, err = api.Retrieve(context.Background(), fs.Arg(0))
+	}
+	if err != nil {
+		return err
+	}
+	data := []byte(object.Value)
+	switch encoding := object.Encoding; encoding {
+	case "":
+	case "base64url":
+		data, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(object.Value, "="))
+		if err != nil {
+			return errors.New("object is not valid base64url: " + err.Error())
+		}
+	default:
+		return errors.New("don't know how to decode " + encoding)
+	}
+	if *out == "" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(*out, data, 0644)
+}
+
+func cmdRm(args []string) error {
+	fs := flag.NewFlagSet("rm", flag.ExitOnError)
+	version := fs.Int64("version", 0, "purge this version of a versioned object for good")
+	fs.Usage = usageFor(fs, "rm [flags] PATH...", "Deletes objects.")
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	failed := false
+	for _, path := range fs.Args() {
+		var err error
+		if *version > 0 {
+			err = api.DeleteVersion(context.Background(), path, *version)
+		} else {
+			err = api.Delete(context.Background(), path)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "eks: "+path+": "+err.Error())
+			failed = true
+		} else if outputFormat != "json" {
+			fmt.Println("deleted " + path)
+		}
+	}
+	if failed {
+		return errors.New("not everything was deleted")
+	}
+	return nil
+}
+
+func cmdLs(args []string) error {
+	fs := flag.NewFlagSet("ls", flag.ExitOnError)
+	delimiter := fs.String("delimiter", "", "roll up paths at this delimiter, e.g. -delimiter .")
+	limit := fs.Int("limit", 0, "objects per page (the controller caps this at 1000)")
+	all := fs.Bool("all", false, "keep fetching until the listing is complete")
+	fs.Usage = usageFor(fs, "ls [flags] [PREFIX]", "Lists objects, in path order.")
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	opts := client.ListOptions{Prefix: fs.Arg(0), Delimiter: *delimiter, Limit: *limit}
+	var result client.Listing
+	for {
+		page, err := api.List(context.Background(), opts)
+		if err != nil {
+			return err
+		}
+		result.Objects = append(result.Objects, page.Objects...)
+		result.CommonPrefixes = append(result.CommonPrefixes, page.CommonPrefixes...)
+		result.Truncated = page.Truncated
+		result.Continuation = page.Continuation
+		if !*all || !page.Truncated {
+			break
+		}
+		opts.Continuation = page.Continuation
+	}
+	if outputFormat == "json" {
+		printJSON(result)
+		return nil
+	}
+	table := newTable()
+	fmt.Fprintln(table, "PATH\tSIZE\tVERSION\tMODIFIED")
+	for _, prefix := range result.CommonPrefixes {
+		fmt.Fprintln(table, prefix+"\tPRE\t\t")
+	}
+	for _, object := range result.Objects {
+		version := "-"
+		if object.Version > 0 {
+			version = strconv.FormatInt(object.Version, 10)
+		}
+		fmt.Fprintln(table, object.Path+"\t"+humanBytes(object.Size)+"\t"+version+"\t"+object.Modified.Local().Format("2006-01-02 15:04:05"))
+	}
+	table.Flush()
+	if result.Truncated {
+		fmt.Println("(more; use -all, or the continuation " + result.Continuation + ")")
+	}
+	return nil
+}
+
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+//																														//
+// Admin commands																										//
+//																														//
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func cmdStatus(args []string) error {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	fs.Usage = usageFor(fs, "status", "Shows the state of the service and how full each cell is.")
+	fs.Parse(args)
+	status, err := api.Status(context.Background())
+	if err != nil {
+		return err
+	}
+	if outputFormat == "json" {
+		printJSON(status)
+		return nil
+	}
+	table := newTable()
+	fmt.Fprintln(table, "revision:\t"+strconv.Itoa(status.Revision))
+	fmt.Fprintln(table, "state:\t"+status.State)
+	if op := status.LastOperation; op != nil {
+		line := op.Name + " " + op.Result + ", started " + sinceString(op.Started)
+		if op.Error != "" {
+			line += ": " + op.Error
+		}
+		if op.Skipped > 0 {
+			line += " (" + strconv.Itoa(op.Skipped) + " keys skipped)"
+		}
+		fmt.Fprintln(table, "last operation:\t"+line)
+	}
+	fmt.Fprintln(table, "cells:\t"+strconv.Itoa(status.NumberOfCells)+" ("+strconv.Itoa(status.CellsAlive)+" alive)")
+	fmt.Fprintln(table, "used:\t"+humanBytes(status.UsedSpace)+" of "+humanBytes(status.TotalSpace)+" ("+percent(status.UsedSpace, status.TotalSpace)+")")
+	fmt.Fprintln(table, "scale up below:\t"+humanBytes(status.ScaleUpThreshold)+" free")
+	fmt.Fprintln(table, "scale down above:\t"+humanBytes(status.ScaleDownThreshold)+" free")
+	fmt.Fprintln(table, "checksum mismatches:\t"+strconv.FormatInt(status.ChecksumMismatches, 10))
+	fmt.Fprintln(table, "corruptions reported:\t"+strconv.FormatInt(status.CorruptionsReported, 10))
+	fmt.Fprintln(table, "open circuits:\t"+intsToString(status.OpenCircuits))
+	table.Flush()
+	fmt.Println()
+	table = newTable()
+	fmt.Fprintln(table, "CELL\tCAPACITY\tUSED\tFREE\tFILES\tUTIL\tHEALTH\tLAST SEEN")
+	for _, cell := range status.Cells {
+		used := cell.Capacity - cell.FreeSpace
+		health := "down"
+		if cell.Healthy {
+			health = "ok"
+		}
+		if cell.CircuitOpen {
+			health += ", circuit open"
+		}
+		lastSeen := "never"
+		if cell.LastSeen != nil {
+			lastSeen = sinceString(*cell.LastSeen)
+		}
+		fmt.Fprintln(table, strconv.Itoa(cell.CellId)+"\t"+humanBytes(cell.Capacity)+"\t"+humanBytes(used)+"\t"+
+			humanBytes(cell.FreeSpace)+"\t"+strconv.FormatInt(cell.Objects, 10)+"\t"+percent(used, cell.Capacity)+"\t"+
+			health+"\t"+lastSeen)
+	}
+	table.Flush()
+	return nil
+}
+
+func cmdFsck(args []string) error {
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := fs.Bool("repair", false, "fix what is found")
+	fs.Usage = usageFor(fs, "fsck [flags]", "Checks the directory against what the cells hold.")
+	fs.Parse(args)
+	summary, err := api.Fsck(context.Background(), *repair)
+	if err != nil {
+		return err
+	}
+	if outputFormat == "json" {
+		printJSON(summary)
+		return nil
+	}
+	table := newTable()
+	fmt.Fprintln(table, "cells checked:\t"+strconv.Itoa(summary.CellsChecked))
+	fmt.Fprintln(table, "unreachable cells:\t"+intsToString(summary.UnreachableCells))
+	fmt.Fprintln(table, "orphans:\t"+strconv.Itoa(len(summary.Orphans)))
+	fmt.Fprintln(table, "dangling entries:\t"+strconv.Itoa(len(summary.Dangling)))
+	fmt.Fprintln(table, "used:\t"+humanBytes(summary.UsedSpace)+" of "+humanBytes(summary.TotalSpace))
+	fmt.Fprintln(table, "repaired:\t"+strconv.FormatBool(summary.Repair))
+	table.Flush()
+	if len(summary.Orphans)+len(summary.Dangling) > 0 {
+		fmt.Println()
+		table = newTable()
+		fmt.Fprintln(table, "KIND\tCELL\tKEY\tPATH\tSIZE")
+		for _, item := range summary.Orphans {
+			fmt.Fprintln(table, "orphan\t"+strconv.Itoa(item.CellId)+"\t"+item.Key+"\t-\t"+humanBytes(item.Size))
+		}
+		for _, item := range summary.Dangling {
+			fmt.Fprintln(table, "dangling\t"+strconv.Itoa(item.CellId)+"\t"+item.Key+"\t"+item.Path+"\t"+humanBytes(item.Size))
+		}
+		table.Flush()
+	}
+	for _, message := range summary.Errors {
+		fmt.Fprintln(os.Stderr, "eks: fsck: "+message)
+	}
+	return nil
+}
+
+func cmdUsage(args []string) error {
+	fs := flag.NewFlagSet("usage", flag.ExitOnError)
+	fs.Usage = usageFor(fs, "usage", "Shows what each category stores, against its quota.")
+	fs.Parse(args)
+	usage, err := api.Usage(context.Background())
+	if err != nil {
+		return err
+	}
+	if outputFormat == "json" {
+		printJSON(usage)
+		return nil
+	}
+	table := newTable()
+	fmt.Fprintln(table, "CATEGORY\tUSED\tBYTE QUOTA\tOBJECTS\tOBJECT QUOTA")
+	for _, category := range usage {
+		bytesQuota, objectsQuota := "-", "-"
+		if category.MaxBytes > 0 {
+			bytesQuota = humanBytes(category.MaxBytes) + " (" + percent(category.UsedBytes, category.MaxBytes) + ")"
+		}
+		if category.MaxObjects > 0 {
+			objectsQuota = strconv.FormatInt(category.MaxObjects, 10) + " (" + percent(category.Objects, category.MaxObjects) + ")"
+		}
+		fmt.Fprintln(table, category.Category+"\t"+humanBytes(category.UsedBytes)+"\t"+bytesQuota+"\t"+
+			strconv.FormatInt(category.Objects, 10)+"\t"+objectsQuota)
+	}
+	table.Flush()
+	return nil
+}
+
+// cmdKeys lists API keys, or issues or revokes them
+func cmdKeys(args []string) error {
+	fs := flag.NewFlagSet("keys", flag.ExitOnError)
+	name := fs.String("name", "", "issue: what the key is for")
+	permissions := fs.String("permissions", "read", "issue: read, write and/or admin, comma separated")
+	categories := fs.String("categories", "default", "issue: categories the key works on, comma separated, * for all")
+	fs.Usage = usageFor(fs, "keys [issue [flags] | revoke ID...]", "Lists API keys, issues a new one or revokes some.")
+	subcommand := ""
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		subcommand, args = args[0], args[1:]
+	}
+	fs.Parse(args)
+	switch subcommand {
+	case "":
+		if fs.NArg() > 0 {
+			fs.Usage()
+			os.Exit(2)
+		}
+	case "issue":
+		issued, err := api.IssueKey(context.Background(), *name, strings.Split(*permissions, ","), strings.Split(*categories, ","))
+		if err != nil {
+			return err
+		}
+		if outputFormat == "json" {
+			printJSON(issued)
+		} else {
+			fmt.Println(issued.Key)
+			fmt.Fprintln(os.Stderr, "eks: key "+issued.Id+" issued; it cannot be shown again")
+		}
+		return nil
+	case "revoke":
+		if fs.NArg() < 1 {
+			fs.Usage()
+			os.Exit(2)
+		}
+		failed := false
+		for _, id := range fs.Args() {
+			if err := api.RevokeKey(context.Background(), id); err != nil {
+				fmt.Fprintln(os.Stderr, "eks: "+id+": "+err.Error())
+				failed = true
+			} else if outputFormat != "json" {
+				fmt.Println("revoked " + id)
+			}
+		}
+		if failed {
+			return errors.New("not every key was revoked")
+		}
+		return nil
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+	keys, err := api.ListKeys(context.Background())
+	if err != nil {
+		return err
+	}
+	if outputFormat == "json" {
+		printJSON(keys)
+		return nil
+	}
+	table := newTable()
+	fmt.Fprintln(table, "ID\tNAME\tPERMISSIONS\tCATEGORIES\tCREATED\tREVOKED")
+	for _, k := range keys {
+		revoked := "-"
+		if k.Revoked != nil {
+			revoked = sinceString(*k.Revoked)
+		}
+		fmt.Fprintln(table, k.Id+"\t"+k.Name+"\t"+strings.Join(k.Permissions, ",")+"\t"+strings.Join(k.Categories, ",")+"\t"+
+			sinceString(k.Created)+"\t"+revoked)
+	}
+	table.Flush()
+	return nil
+}
+
+// adminTrigger is for the admin commands that start something on the
+// controller and return straight away
+func adminTrigger(name string, trigger func(*client.Client, context.Context) (string, error), description string) func(args []string) error {
+	return func(args []string) error {
+		fs := flag.NewFlagSet(name, flag.ExitOnError)
+		fs.Usage = usageFor(fs, name, description)
+		fs.Parse(args)
+		result, err := trigger(api, context.Background())
+		if err != nil {
+			return err
+		}
+		if outputFormat == "json" {
+			printJSON(map[string]string{"result": result})
+		} else {
+			fmt.Println(result + "; follow it with eks status")
+		}
+		return nil
+	}
+}
+
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+//																														//
+// main function																										//
+//																														//
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+type command struct {
+	name        string
+	description string
+	run         func(args []string) error
+}
+
+var commands []command
+
+func usageFor(fs *flag.FlagSet, synopsis string, description string) func() {
+	return func() {
+		out := fs.Output()
+		fmt.Fprintln(out, "usage: eks [global flags] "+synopsis)
+		fmt.Fprintln(out, description)
+		fs.PrintDefaults()
+	}
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintln(out, "usage: eks [global flags] <command> [arguments]")
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "commands:")
+	table := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintln(table, "  "+cmd.name+"\t"+cmd.description)
+	}
+	table.Flush()
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "global flags:")
+	flag.PrintDefaults()
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "run eks <command> -h for the flags of a command")
+}
+
+func main() {
+	commands = []command{
+		{"put", "store a file or stdin as an object", cmdPut},
+		{"get", "write an object to stdout or a file", cmdGet},
+		{"rm", "delete objects", cmdRm},
+		{"ls", "list objects", cmdLs},
+		{"status", "service status and per-cell utilization", cmdStatus},
+		{"fsck", "check the directory against the cells", cmdFsck},
+		{"usage", "bytes and objects stored per category, against quotas", cmdUsage},
+		{"keys", "list, issue and revoke API keys", cmdKeys},
+		{"drain", "drain the last cell and scale down", adminTrigger("drain", (*client.Client).Drain, "Moves everything off the last cell and removes it.")},
+		{"rebalance", "even out usage across cells", adminTrigger("rebalance", (*client.Client).Rebalance, "Moves objects from the fullest cells to the emptiest.")},
+	}
+
+	defaultController := os.Getenv("EKS_CONTROLLER")
+	if defaultController == "" {
+		defaultController = "http://localhost:2222"
+	}
+	controller := flag.String("controller", defaultController, "controller URL (or set EKS_CONTROLLER)")
+	key := flag.String("key", os.Getenv("EKS_API_KEY"), "API key (or set EKS_API_KEY)")
+	flag.StringVar(&outputFormat, "o", "table", "output format: table or json")
+	flag.Usage = usage
+	flag.Parse()
+	api = client.New(*controller, client.WithAPIKey(*key), client.WithHTTPClient(&http.Client{Timeout: requestTimeout}))
+	if outputFormat != "table" && outputFormat != "json" {
+		fmt.Fprintln(os.Stderr, "eks: -o must be table or json")
+		os.Exit(2)
+	}
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	for _, cmd := range commands {
+		if cmd.name == flag.Arg(0) {
+			if err := cmd.run(flag.Args()[1:]); err != nil {
+				fmt.Fprintln(os.Stderr, "eks: "+err.Error())
+				os.Exit(1)
+			}
+			return
+		}
+	}
+	fmt.Fprintln(os.Stderr, "eks: unknown command "+flag.Arg(0))
+	usage()
+	os.Exit(2)
+}
@@ -0,0 +1,7 @@
+#!/bin/sh
+# Regenerates the gRPC code for the controller and the cells from cell.proto.
+# Needs protoc, protoc-gen-go and protoc-gen-go-grpc on the PATH.
+cd "$(dirname "$0")"
+for dir in ../controller ../cells; do
+	protoc --go_out=$dir --go-grpc_out=$dir cell.proto
+done